@@ -0,0 +1,262 @@
+package emailqueue
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gocelery/gocelery"
+	"github.com/streadway/amqp"
+)
+
+// amqpBroker publishes Celery messages to RabbitMQ. It implements
+// gocelery.CeleryBroker so Delay can submit through it. Unlike gocelery's AMQP
+// broker it dials lazily, publishes to the configured queue instead of always
+// "celery" and returns connection errors instead of panicking. It only
+// produces tasks, so GetTaskMessage always fails.
+type amqpBroker struct {
+	mu         sync.Mutex
+	url        string
+	queueName  string
+	exchange   string // When set, messages are published here with routingKey instead of to the queue
+	routingKey string
+	conn       *amqp.Connection
+	channel    *amqp.Channel
+	declared   map[string]bool // Queues known to exist on the current channel
+}
+
+// IsAMQPURL reports whether rawURL uses the amqp:// or amqps:// scheme
+func IsAMQPURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "amqp" || u.Scheme == "amqps")
+}
+
+// newAMQPBroker returns a broker publishing to queueName on the AMQP server
+// at rawURL, or to exchange with routingKey when exchange is set. No
+// connection is made until the first call that needs one.
+func newAMQPBroker(rawURL, queueName, exchange, routingKey string) *amqpBroker {
+	return &amqpBroker{url: rawURL, queueName: queueName, exchange: exchange, routingKey: routingKey}
+}
+
+// SendCeleryMessage publishes message to the configured queue
+func (b *amqpBroker) SendCeleryMessage(message *gocelery.CeleryMessage) error {
+	return b.publish(b.queueName, message)
+}
+
+// GetTaskMessage is not supported; the broker only produces tasks
+func (b *amqpBroker) GetTaskMessage() (*gocelery.TaskMessage, error) {
+	return nil, errors.New("consuming tasks is not supported by the AMQP broker")
+}
+
+// publish sends message to queueName through the default exchange, declaring
+// the queue once per channel when it does not exist yet, or to the
+// configured exchange with the configured routing key, leaving the choice of
+// queue to the exchange bindings. The encoded Celery task is the raw message
+// body, as Celery's AMQP transport expects, and the message headers and
+// priority become AMQP headers and priority.
+func (b *amqpBroker) publish(queueName string, message *gocelery.CeleryMessage) error {
+	body, err := base64.StdEncoding.DecodeString(message.Body)
+	if err != nil {
+		return fmt.Errorf("failed to decode task body: %v", err)
+	}
+
+	publishing := amqp.Publishing{
+		Headers:         amqpTable(message.Headers),
+		ContentType:     message.ContentType,
+		ContentEncoding: message.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        uint8(message.Properties.DeliveryInfo.Priority),
+		CorrelationId:   message.Properties.CorrelationID,
+		ReplyTo:         message.Properties.ReplyTo,
+		Timestamp:       time.Now(),
+		Body:            body,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.openChannel(); err != nil {
+		return err
+	}
+	if b.exchange != "" {
+		return b.runOnChannel(func(channel *amqp.Channel) error {
+			return channel.Publish(b.exchange, b.routingKey, false, false, publishing)
+		})
+	}
+	if err := b.ensureQueue(queueName); err != nil {
+		return err
+	}
+	return b.runOnChannel(func(channel *amqp.Channel) error {
+		return channel.Publish("", queueName, false, false, publishing)
+	})
+}
+
+// amqpTable converts message headers to an AMQP table. The AMQP client only
+// encodes nested tables of type amqp.Table and arrays of []interface{}, so
+// nested maps and slices are converted recursively.
+func amqpTable(headers map[string]interface{}) amqp.Table {
+	if headers == nil {
+		return nil
+	}
+	table := make(amqp.Table, len(headers))
+	for key, value := range headers {
+		table[key] = amqpValue(value)
+	}
+	return table
+}
+
+// amqpValue converts one header value for amqpTable
+func amqpValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return amqpTable(v)
+	case map[string]string:
+		table := make(amqp.Table, len(v))
+		for key, item := range v {
+			table[key] = item
+		}
+		return table
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = amqpValue(item)
+		}
+		return items
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = item
+		}
+		return items
+	case int:
+		return int64(v)
+	}
+	return value
+}
+
+// errQueueNotFound reports a passive declaration of a queue that does not exist
+var errQueueNotFound = errors.New("queue not found")
+
+// ensureQueue makes sure queueName exists before publishing to it through the
+// default exchange, which would otherwise drop the message. The check is made
+// once per channel. An existing queue is only declared passively, so queues
+// the workers declared with arguments such as x-max-priority are used as they
+// are; a missing one is declared durable without arguments. Callers hold b.mu
+// and have opened the channel.
+func (b *amqpBroker) ensureQueue(queueName string) error {
+	if b.declared[queueName] {
+		return nil
+	}
+
+	err := b.runOnChannel(func(channel *amqp.Channel) error {
+		if _, err := channel.QueueDeclarePassive(queueName, true, false, false, false, nil); err != nil {
+			var amqpErr *amqp.Error
+			if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+				return errQueueNotFound
+			}
+			return err
+		}
+		return nil
+	})
+	if errors.Is(err, errQueueNotFound) {
+		// The failed passive declaration closed the channel
+		if err = b.openChannel(); err == nil {
+			err = b.runOnChannel(func(channel *amqp.Channel) error {
+				_, err := channel.QueueDeclare(queueName, true, false, false, false, nil)
+				return err
+			})
+		}
+	}
+	if err != nil {
+		return err
+	}
+	b.declared[queueName] = true
+	return nil
+}
+
+// queueDepth returns the number of messages ready in queueName
+func (b *amqpBroker) queueDepth(queueName string) (int, error) {
+	var depth int
+	err := b.withChannel(func(channel *amqp.Channel) error {
+		queue, err := channel.QueueInspect(queueName)
+		depth = queue.Messages
+		return err
+	})
+	return depth, err
+}
+
+// purge removes the messages ready in queueName and returns how many were removed
+func (b *amqpBroker) purge(queueName string) (int, error) {
+	var removed int
+	err := b.withChannel(func(channel *amqp.Channel) error {
+		var err error
+		removed, err = channel.QueuePurge(queueName, false)
+		return err
+	})
+	return removed, err
+}
+
+// ping opens the connection and channel if they are not already open
+func (b *amqpBroker) ping() error {
+	return b.withChannel(func(*amqp.Channel) error { return nil })
+}
+
+// withChannel runs fn on the shared channel, dialing first when needed. AMQP
+// closes a channel on any error, so a failed fn drops it and the next call
+// opens a new one.
+func (b *amqpBroker) withChannel(fn func(*amqp.Channel) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.openChannel(); err != nil {
+		return err
+	}
+	return b.runOnChannel(fn)
+}
+
+// openChannel dials and opens the shared channel if they are not open. A new
+// channel starts with no queues known to exist. Callers hold b.mu.
+func (b *amqpBroker) openChannel() error {
+	if b.conn == nil || b.conn.IsClosed() {
+		conn, err := amqp.Dial(b.url)
+		if err != nil {
+			return fmt.Errorf("failed to connect to AMQP broker: %v", err)
+		}
+		b.conn, b.channel = conn, nil
+	}
+	if b.channel == nil {
+		channel, err := b.conn.Channel()
+		if err != nil {
+			return fmt.Errorf("failed to open AMQP channel: %v", err)
+		}
+		b.channel = channel
+		b.declared = make(map[string]bool)
+	}
+	return nil
+}
+
+// runOnChannel runs fn on the open channel and drops the channel when fn
+// fails. Callers hold b.mu.
+func (b *amqpBroker) runOnChannel(fn func(*amqp.Channel) error) error {
+	if err := fn(b.channel); err != nil {
+		b.channel.Close()
+		b.channel = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection, if one was opened
+func (b *amqpBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil || b.conn.IsClosed() {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn, b.channel = nil, nil
+	return err
+}
@@ -0,0 +1,138 @@
+package emailqueue
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting Redis while the circuit
+// breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the submission circuit breaker
+type CircuitState int
+
+// Circuit breaker states
+const (
+	CircuitClosed   CircuitState = iota // Submissions flow normally
+	CircuitOpen                         // Submissions fail fast until the cooldown elapses
+	CircuitHalfOpen                     // A single probe submission tests whether Redis recovered
+)
+
+// String returns the lowercase state name used in logs
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops submissions after threshold consecutive failures. Once
+// cooldown has passed it lets one probe through; a successful probe closes
+// the circuit and a failed one reopens it. A nil breaker allows everything.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     CircuitState
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+// newCircuitBreaker returns a breaker that opens after threshold consecutive
+// failures, or nil when threshold is not positive
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a submission may proceed, returning ErrCircuitOpen
+// while the circuit is open or a half-open probe is already in flight
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && cb.now().Sub(cb.openedAt) >= cb.cooldown {
+		cb.setState(CircuitHalfOpen)
+	}
+
+	switch cb.state {
+	case CircuitOpen:
+		return ErrCircuitOpen
+	case CircuitHalfOpen:
+		if cb.probing {
+			return ErrCircuitOpen
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a submission let through by allow
+func (cb *circuitBreaker) record(err error) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	if err == nil {
+		cb.failures = 0
+		if cb.state != CircuitClosed {
+			cb.setState(CircuitClosed)
+		}
+		return
+	}
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.threshold {
+		cb.openedAt = cb.now()
+		cb.setState(CircuitOpen)
+	}
+}
+
+// State returns the current state, reporting an open circuit whose cooldown
+// has elapsed as half-open
+func (cb *circuitBreaker) State() CircuitState {
+	if cb == nil {
+		return CircuitClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == CircuitOpen && cb.now().Sub(cb.openedAt) >= cb.cooldown {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// setState switches state and logs the transition; callers hold cb.mu
+func (cb *circuitBreaker) setState(state CircuitState) {
+	if cb.state == state {
+		return
+	}
+	cb.state = state
+
+	switch state {
+	case CircuitOpen:
+		logWarn("circuit_opened", Fields{"failures": cb.failures, "cooldown": cb.cooldown.String()},
+			"🔌 Circuit breaker opened after %d consecutive failures, failing fast for %v", cb.failures, cb.cooldown)
+	case CircuitHalfOpen:
+		logInfo("circuit_half_open", nil, "🔌 Circuit breaker half-open, probing Redis")
+	case CircuitClosed:
+		logInfo("circuit_closed", nil, "🔌 Circuit breaker closed, Redis recovered")
+	}
+}
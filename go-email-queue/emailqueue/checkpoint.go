@@ -0,0 +1,174 @@
+package emailqueue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultCheckpointFile is the checkpoint file used by --resume when
+// --checkpoint is not set
+const DefaultCheckpointFile = ".email_queue_checkpoint.json"
+
+// DefaultCheckpointInterval is the minimum time between checkpoint writes
+// during a run
+const DefaultCheckpointInterval = time.Second
+
+// Checkpoint records how far a run got through its email files. Files are
+// queued in a deterministic order (sorted by name or modification time), so
+// the first Index files were queued or skipped and a resumed run starts after
+// them. A failed file ends that prefix, so the resumed run retries it.
+type Checkpoint struct {
+	Dir      string    `json:"dir"`      // Data directory of the run
+	Index    int       `json:"index"`    // Number of leading files that were queued or skipped
+	Filename string    `json:"filename"` // The last of those files, checked on resume to detect a changed file list
+	Total    int       `json:"total"`    // Number of files the run found
+	Updated  time.Time `json:"updated"`  // When the checkpoint was written
+}
+
+// ReadCheckpoint reads a checkpoint written by a previous run; ok is false
+// when the file does not exist
+func ReadCheckpoint(path string) (checkpoint Checkpoint, ok bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Checkpoint{}, false, nil
+	}
+	if err != nil {
+		return Checkpoint{}, false, fmt.Errorf("failed to read checkpoint file: %v", err)
+	}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return Checkpoint{}, false, fmt.Errorf("invalid checkpoint file %s: %v", path, err)
+	}
+	return checkpoint, true, nil
+}
+
+// resumeFromCheckpoint returns the files left to queue after the checkpoint at
+// path and how many were skipped. A missing checkpoint resumes from the start;
+// a checkpoint whose last file is not at its index in files means the file
+// list changed and the resume is refused, since skipping by index would then
+// drop the wrong emails.
+func resumeFromCheckpoint(path, dir string, files []string) ([]string, int, error) {
+	checkpoint, ok, err := ReadCheckpoint(path)
+	if err != nil || !ok || checkpoint.Index == 0 {
+		return files, 0, err
+	}
+	if checkpoint.Dir != dir {
+		return nil, 0, fmt.Errorf("checkpoint %s was written for %s, not %s", path, checkpoint.Dir, dir)
+	}
+	if checkpoint.Index > len(files) || files[checkpoint.Index-1] != checkpoint.Filename {
+		return nil, 0, fmt.Errorf("checkpoint %s does not match the email files: expected %s as file %d; remove the checkpoint to start over",
+			path, checkpoint.Filename, checkpoint.Index)
+	}
+	return files[checkpoint.Index:], checkpoint.Index, nil
+}
+
+// checkpointer tracks which emails of a run were queued or skipped and writes
+// the length of that prefix to the checkpoint file. Workers finish emails out
+// of order, and failed emails must run again, so only the prefix before the
+// first email that is unhandled or failed is safe to skip on resume.
+type checkpointer struct {
+	path     string
+	dir      string
+	files    []string
+	offset   int // Files skipped by the resume, which precede files
+	interval time.Duration
+
+	mu      sync.Mutex
+	done    []bool
+	next    int // Index in files of the first email not queued or skipped
+	written int // Value of next when the checkpoint was last written
+	last    time.Time
+}
+
+// newCheckpointer returns a checkpointer for files, the emails left after
+// skipping offset files on resume; it returns nil when path is empty
+func newCheckpointer(path, dir string, files []string, offset int) *checkpointer {
+	if path == "" {
+		return nil
+	}
+	return &checkpointer{
+		path:     path,
+		dir:      dir,
+		files:    files,
+		offset:   offset,
+		interval: DefaultCheckpointInterval,
+		done:     make([]bool, len(files)),
+		written:  -1,
+	}
+}
+
+// markDone records that the email at index i of files was queued or skipped
+// and writes the checkpoint when the prefix grew and the interval has passed.
+// Failed emails are never marked, so the checkpoint stops before them.
+func (c *checkpointer) markDone(i int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.done[i] = true
+	for c.next < len(c.done) && c.done[c.next] {
+		c.next++
+	}
+	if c.next != c.written && time.Since(c.last) >= c.interval {
+		c.write()
+	}
+}
+
+// finish writes the final checkpoint. When every email was queued or skipped
+// the checkpoint file is removed instead, so the next --resume starts over.
+func (c *checkpointer) finish() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.next == len(c.files) {
+		if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logWarn("checkpoint_failed", Fields{"path": c.path, "error": err}, "⚠️  Failed to remove checkpoint file: %v", err)
+		}
+		return
+	}
+	if c.offset+c.next == 0 {
+		return
+	}
+	if c.next != c.written {
+		c.write()
+	}
+	logInfo("checkpoint_written", Fields{"path": c.path, "index": c.offset + c.next},
+		"📍 Checkpoint saved to %s after %d email files; rerun with --resume to continue", c.path, c.offset+c.next)
+}
+
+// write saves the checkpoint through a temporary file, so a crash while
+// writing leaves the previous checkpoint intact. c.mu must be held.
+func (c *checkpointer) write() {
+	c.written = c.next
+	c.last = time.Now()
+	// Until an email is handled the existing checkpoint, if any, is current
+	if c.next == 0 {
+		return
+	}
+
+	checkpoint := Checkpoint{
+		Dir:      c.dir,
+		Index:    c.offset + c.next,
+		Filename: c.files[c.next-1],
+		Total:    c.offset + len(c.files),
+		Updated:  c.last.UTC(),
+	}
+
+	temp := c.path + ".tmp"
+	if err := writeJSONFile(temp, checkpoint, "checkpoint file"); err != nil {
+		logWarn("checkpoint_failed", Fields{"path": c.path, "error": err}, "⚠️  %v", err)
+		return
+	}
+	if err := os.Rename(temp, c.path); err != nil {
+		logWarn("checkpoint_failed", Fields{"path": c.path, "error": err}, "⚠️  Failed to write checkpoint file: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package emailqueue
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfigFile reads settings from a YAML or JSON file (chosen by a .json
+// extension) and applies them to the flags of fs that were not set on the
+// command line, so flags override the file and the file overrides environment
+// variables. Keys are flag names, with - or _ as separator, e.g. redis-url or
+// redis_url. Settings without a flag are keyed by the name of their
+// environment variable in env, in any case, e.g. celery_task_name, and are
+// applied by setting that variable only when it is not already in the
+// environment, so for these the real environment wins. Values are scalars, and lists are joined
+// with commas for flags such as queues. Unknown keys are reported together as
+// one error.
+func LoadConfigFile(fs *flag.FlagSet, path string, env []string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var settings map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &settings)
+	} else {
+		err = yaml.Unmarshal(data, &settings)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	envNames := make(map[string]bool, len(env))
+	for _, name := range env {
+		envNames[name] = true
+	}
+
+	var unknown []string
+	for _, key := range keys {
+		if envName := strings.ToUpper(strings.ReplaceAll(key, "-", "_")); envNames[envName] {
+			value, err := configValue(settings[key])
+			if err != nil {
+				return fmt.Errorf("invalid config file %s: %s: %v", path, key, err)
+			}
+			if _, set := os.LookupEnv(envName); set {
+				continue
+			}
+			if err := os.Setenv(envName, value); err != nil {
+				return fmt.Errorf("invalid config file %s: %s: %v", path, key, err)
+			}
+			continue
+		}
+
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == "config" || fs.Lookup(name) == nil {
+			unknown = append(unknown, key)
+			continue
+		}
+		if explicit[name] {
+			continue
+		}
+
+		value, err := configValue(settings[key])
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %s: %v", path, key, err)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid config file %s: %s: %v", path, key, err)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("invalid config file %s: unknown keys: %s", path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// configValue renders a config file value as a flag value
+func configValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	case float64:
+		// JSON decodes every number as float64; keep integers free of exponents
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(value))
+		for i, item := range value {
+			text, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = text
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a scalar or a list, got %s", jsonTypeName(value))
+}
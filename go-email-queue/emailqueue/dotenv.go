@@ -0,0 +1,78 @@
+package emailqueue
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// DefaultEnvFile is the file main loads environment settings from when present
+const DefaultEnvFile = ".env"
+
+// LoadEnvFile sets the variables assigned in a .env file that are not already
+// set in the environment, so real environment variables, and flags falling back
+// to them, keep precedence. Lines hold KEY=VALUE pairs, optionally prefixed with
+// "export"; blank lines and lines starting with # are ignored. Values may be
+// wrapped in single or double quotes, and unquoted values end at " #". A
+// missing file is not an error.
+func LoadEnvFile(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read env file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		key, value, ok, err := parseEnvLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("invalid env file %s line %d: %v", path, lineNumber, err)
+		}
+		if !ok {
+			continue
+		}
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("failed to set %s from env file: %v", key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read env file: %v", err)
+	}
+	return nil
+}
+
+// parseEnvLine parses one .env line; ok is false for blank and comment lines
+func parseEnvLine(line string) (key, value string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+	key, value, found := strings.Cut(line, "=")
+	key = strings.TrimSpace(key)
+	if !found || key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false, errors.New("expected KEY=VALUE")
+	}
+
+	value = strings.TrimSpace(value)
+	if len(value) > 0 && (value[0] == '"' || value[0] == '\'') {
+		end := strings.IndexByte(value[1:], value[0])
+		if end < 0 {
+			return "", "", false, fmt.Errorf("unterminated quote in value of %s", key)
+		}
+		return key, value[1 : end+1], true, nil
+	}
+	if comment := strings.Index(value, " #"); comment >= 0 {
+		value = strings.TrimSpace(value[:comment])
+	}
+	return key, value, true, nil
+}
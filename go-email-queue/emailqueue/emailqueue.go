@@ -0,0 +1,1982 @@
+// Package emailqueue validates email files and queues them as Celery tasks
+// for the email classification workers. The email-queue-manager binary is a
+// thin command-line front end over it.
+package emailqueue
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocelery/gocelery"
+	"github.com/gomodule/redigo/redis"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	uuid "github.com/satori/go.uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultTaskName is the Celery task that processes a queued email file
+const DefaultTaskName = "app.tasks.process_email_task"
+
+// MaxPriority is the highest task priority accepted by AddEmailToQueueWithPriority
+const MaxPriority = 9
+
+// redisPrioritySteps mirrors kombu's default Redis transport priority_steps.
+// Kombu emulates priorities on Redis with one list per step: priority 0 uses
+// the plain queue list, higher steps use "<queue>\x06\x16<step>". Workers poll
+// the lists in step order, so on Redis a LOWER number is a HIGHER priority.
+var redisPrioritySteps = []int{0, 3, 6, 9}
+
+// Backoff bounds for AddEmailToQueueWithRetry
+const (
+	initialRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 5 * time.Second
+)
+
+// Backoff bounds while Redis is out of memory or loading its dataset. Both
+// last seconds to minutes, so retrying at the connection error pace only
+// adds load.
+const (
+	initialBusyBackoff = 1 * time.Second
+	maxBusyBackoff     = 30 * time.Second
+)
+
+// resultPollInterval matches the polling interval of gocelery's AsyncResult.Get
+const resultPollInterval = 50 * time.Millisecond
+
+// Config holds the settings used to build an EmailQueueManager. Zero values
+// fall back to the defaults listed on each field.
+type Config struct {
+	RedisURL         string          // Redis connection URL for the submission bookkeeping and, unless overridden, the broker and result backend (default: redis://localhost:6379/0)
+	BrokerURL        string          // Broker URL; amqp:// or amqps:// selects RabbitMQ, redis:// or rediss:// a separate Redis (default: RedisURL)
+	BackendURL       string          // Redis URL of the result backend, for deployments that keep results apart from the broker (default: RedisURL)
+	QueueName        string          // Celery queue name (default: celery)
+	TaskName         string          // Celery task invoked for each email (default: app.tasks.process_email_task)
+	MaxIdle          int             // Maximum idle connections kept in the Redis pool (default: 3)
+	IdleTimeout      time.Duration   // Time after which idle pool connections are closed (default: 240s)
+	MaxActive        int             // Maximum connections each Redis pool opens at once; negative means no limit (default: 10)
+	NoWait           bool            // Fail with redis.ErrPoolExhausted instead of waiting for a connection when MaxActive are in use
+	NumWorkers       int             // Number of gocelery workers (default: 1)
+	Password         string          // Redis password, used when the URL carries no credentials
+	UseTLS           bool            // Dial Redis over TLS even when the URL scheme is redis://
+	DryRun           bool            // Log the tasks that would be submitted without sending them
+	Queues           []string        // Queues AddEmailToQueueRouted spreads tasks across (default: QueueName only)
+	Routing          RoutingStrategy // How AddEmailToQueueRouted picks among Queues (default: RouteRoundRobin)
+	BreakerThreshold int             // Consecutive submission failures that open the circuit breaker; 0 disables it
+	BreakerCooldown  time.Duration   // How long an open circuit fails fast before probing Redis (default: 30s)
+	Serializer       Serializer      // Encoding of task bodies, json or msgpack (default: SerializerJSON)
+	AcceptContent    []string        // The workers' accept_content setting; when set, Serializer must be in it
+	Protocol         Protocol        // Celery message protocol matching the workers' task_protocol, 1 or 2 (default: ProtocolV1)
+	BatchID          string          // When set, sent as the batch_id header of every task so workers can group the results of a run
+	Exchange         string          // AMQP exchange tasks are published to with RoutingKey, e.g. a topic exchange; empty publishes to the queue through the default exchange
+	RoutingKey       string          // Routing key sent in delivery_info instead of the queue name; on an AMQP broker it requires Exchange and is required with it
+	FallbackRedisURL string          // Secondary Redis broker a submission is retried on when the primary fails with a connection error; requires a Redis broker
+}
+
+// RoutingStrategy selects the queue AddEmailToQueueRouted submits to
+type RoutingStrategy string
+
+const (
+	// RouteRoundRobin cycles through the queues in order
+	RouteRoundRobin RoutingStrategy = "round-robin"
+	// RouteHash picks a queue from a hash of the filename, so an email is
+	// always routed to the same queue
+	RouteHash RoutingStrategy = "hash"
+)
+
+// Option customizes a Config passed to NewEmailQueueManager
+type Option func(*Config)
+
+// WithMaxIdle sets the maximum number of idle connections in the Redis pool
+func WithMaxIdle(n int) Option {
+	return func(cfg *Config) {
+		cfg.MaxIdle = n
+	}
+}
+
+// WithIdleTimeout sets how long idle Redis pool connections are kept open
+func WithIdleTimeout(d time.Duration) Option {
+	return func(cfg *Config) {
+		cfg.IdleTimeout = d
+	}
+}
+
+// WithMaxActive sets the maximum number of connections each Redis pool opens
+// at once; a negative n removes the limit
+func WithMaxActive(n int) Option {
+	return func(cfg *Config) {
+		cfg.MaxActive = n
+	}
+}
+
+// WithPoolWait sets whether a caller waits for a free Redis connection when
+// the pool is at MaxActive, rather than failing with redis.ErrPoolExhausted
+func WithPoolWait(wait bool) Option {
+	return func(cfg *Config) {
+		cfg.NoWait = !wait
+	}
+}
+
+// withDefaults returns a copy of the config with unset fields filled in
+func (cfg Config) withDefaults() Config {
+	if cfg.RedisURL == "" {
+		cfg.RedisURL = "redis://localhost:6379/0"
+	}
+	if cfg.BrokerURL == "" {
+		cfg.BrokerURL = cfg.RedisURL
+	}
+	if cfg.BackendURL == "" {
+		cfg.BackendURL = cfg.RedisURL
+	}
+	if cfg.QueueName == "" {
+		cfg.QueueName = "celery"
+	}
+	if cfg.TaskName == "" {
+		cfg.TaskName = DefaultTaskName
+	}
+	if cfg.MaxIdle == 0 {
+		cfg.MaxIdle = 3
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = 240 * time.Second
+	}
+	if cfg.MaxActive == 0 {
+		cfg.MaxActive = 10
+	}
+	if cfg.NumWorkers == 0 {
+		cfg.NumWorkers = 1
+	}
+	if cfg.Routing == "" {
+		cfg.Routing = RouteRoundRobin
+	}
+	if cfg.BreakerCooldown == 0 {
+		cfg.BreakerCooldown = 30 * time.Second
+	}
+	if cfg.Serializer == "" {
+		cfg.Serializer = SerializerJSON
+	}
+	if cfg.Protocol == 0 {
+		cfg.Protocol = ProtocolV1
+	}
+	return cfg
+}
+
+// TaskSubmitter submits Celery tasks. *gocelery.CeleryClient implements it;
+// tests substitute a fake so submission paths can run without Redis.
+type TaskSubmitter interface {
+	Delay(task string, args ...interface{}) (*gocelery.AsyncResult, error)
+}
+
+// ResultBackend reads Celery task results. The Redis result backend
+// implements it; tests substitute a fake so result polling can run without
+// Redis. A result that is not stored yet is reported as errResultPending.
+type ResultBackend interface {
+	GetResult(taskID string) (*gocelery.ResultMessage, error)
+}
+
+// errResultPending is the ResultBackend error for a task with no result yet
+var errResultPending = errors.New("result not available")
+
+// redisResultBackend reads results from the celery-task-meta keys of a Redis
+// result backend
+type redisResultBackend struct {
+	pool *redis.Pool
+}
+
+// GetResult returns the stored result of the task, or errResultPending
+func (b redisResultBackend) GetResult(taskID string) (*gocelery.ResultMessage, error) {
+	conn := b.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", "celery-task-meta-"+taskID))
+	if err == redis.ErrNil {
+		return nil, errResultPending
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result gocelery.ResultMessage
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid result: %v", err)
+	}
+	return &result, nil
+}
+
+// EmailQueueManager handles email queue operations using gocelery. Queue
+// operations go to the broker, Redis or AMQP; the submission bookkeeping of
+// IsSubmitted and MarkSubmitted always lives in Redis.
+type EmailQueueManager struct {
+	submitter    TaskSubmitter
+	redisPool    *redis.Pool // Redis broker, or the RedisURL instance when amqpBroker is set
+	fallbackPool *redis.Pool // Set when FallbackRedisURL is configured
+	amqpBroker   *amqpBroker // Set when BrokerURL is an AMQP URL
+	redisBackend *gocelery.RedisCeleryBackend
+	results      ResultBackend // Reads task results, from redisBackend outside tests
+	config       Config
+	closeOnce    sync.Once
+	nextQueue    atomic.Uint64 // Round-robin position for AddEmailToQueueRouted
+	breaker      *circuitBreaker
+}
+
+// NewEmailQueueManager creates a new email queue manager using gocelery
+func NewEmailQueueManager(cfg Config, opts ...Option) (*EmailQueueManager, error) {
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg = cfg.withDefaults()
+	if cfg.Routing != RouteRoundRobin && cfg.Routing != RouteHash {
+		return nil, fmt.Errorf("invalid routing strategy %q: must be %s or %s", cfg.Routing, RouteRoundRobin, RouteHash)
+	}
+	if cfg.Serializer != SerializerJSON && cfg.Serializer != SerializerMsgpack {
+		return nil, fmt.Errorf("invalid serializer %q: must be %s or %s", cfg.Serializer, SerializerJSON, SerializerMsgpack)
+	}
+	if cfg.Protocol != ProtocolV1 && cfg.Protocol != ProtocolV2 {
+		return nil, fmt.Errorf("invalid protocol %d: must be %d or %d", cfg.Protocol, ProtocolV1, ProtocolV2)
+	}
+	if len(cfg.AcceptContent) > 0 && !cfg.Serializer.acceptedBy(cfg.AcceptContent) {
+		return nil, fmt.Errorf("serializer %s is not accepted by the workers (accept_content: %s)", cfg.Serializer, strings.Join(cfg.AcceptContent, ", "))
+	}
+	if cfg.Exchange != "" && !IsAMQPURL(cfg.BrokerURL) {
+		return nil, errors.New("exchange requires an AMQP broker")
+	}
+	if IsAMQPURL(cfg.BrokerURL) && cfg.Exchange != "" && strings.TrimSpace(cfg.RoutingKey) == "" {
+		return nil, fmt.Errorf("routing key is required to publish to AMQP exchange %q", cfg.Exchange)
+	}
+	// Without an exchange, AMQP messages go to the queue through the default
+	// exchange, so a routing key would only be reported, never routed on
+	if IsAMQPURL(cfg.BrokerURL) && cfg.Exchange == "" && cfg.RoutingKey != "" {
+		return nil, fmt.Errorf("routing key %q requires an exchange on an AMQP broker", cfg.RoutingKey)
+	}
+	if cfg.FallbackRedisURL != "" && IsAMQPURL(cfg.BrokerURL) {
+		return nil, fmt.Errorf("fallback Redis URL requires a Redis broker, got %s", RedactURL(cfg.BrokerURL))
+	}
+
+	dialURL, dialOptions, err := redisDialURL(cfg.RedisURL, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the broker: RabbitMQ for AMQP URLs, otherwise Redis
+	var broker gocelery.CeleryBroker
+	var amqpBroker *amqpBroker
+	var redisPool *redis.Pool
+	if IsAMQPURL(cfg.BrokerURL) {
+		amqpBroker = newAMQPBroker(cfg.BrokerURL, cfg.QueueName, cfg.Exchange, cfg.RoutingKey)
+		broker = amqpBroker
+		redisPool = newRedisPool(dialURL, dialOptions, cfg)
+	} else {
+		brokerDialURL, brokerDialOptions, err := redisDialURL(cfg.BrokerURL, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker URL: %v", err)
+		}
+		redisPool = newRedisPool(brokerDialURL, brokerDialOptions, cfg)
+		redisBroker := gocelery.NewRedisBroker(redisPool)
+		redisBroker.QueueName = cfg.QueueName
+		broker = redisBroker
+	}
+
+	// Create Redis backend for gocelery
+	backendDialURL, backendDialOptions, err := redisDialURL(cfg.BackendURL, cfg)
+	if err != nil {
+		redisPool.Close()
+		return nil, fmt.Errorf("invalid backend URL: %v", err)
+	}
+	redisBackend := gocelery.NewRedisBackend(newRedisPool(backendDialURL, backendDialOptions, cfg))
+
+	// Create the fallback broker pool, dialed only once the primary fails
+	var fallbackPool *redis.Pool
+	if cfg.FallbackRedisURL != "" {
+		fallbackDialURL, fallbackDialOptions, err := redisDialURL(cfg.FallbackRedisURL, cfg)
+		if err != nil {
+			redisPool.Close()
+			redisBackend.Pool.Close()
+			return nil, fmt.Errorf("invalid fallback Redis URL: %v", err)
+		}
+		fallbackPool = newRedisPool(fallbackDialURL, fallbackDialOptions, cfg)
+	}
+
+	// Create Celery client
+	celeryClient, err := gocelery.NewCeleryClient(broker, redisBackend, cfg.NumWorkers)
+	if err != nil {
+		redisPool.Close()
+		redisBackend.Pool.Close()
+		if fallbackPool != nil {
+			fallbackPool.Close()
+		}
+		return nil, fmt.Errorf("failed to create Celery client: %v", err)
+	}
+
+	logDebug("manager_config", Fields{"broker_url": RedactURL(cfg.BrokerURL), "backend_url": RedactURL(cfg.BackendURL),
+		"max_idle": cfg.MaxIdle, "max_active": cfg.MaxActive, "idle_timeout": cfg.IdleTimeout.String(), "serializer": cfg.Serializer},
+		"🔧 Broker %s, backend %s, pool max idle %d, max active %d, idle timeout %v, serializer %s",
+		RedactURL(cfg.BrokerURL), RedactURL(cfg.BackendURL), cfg.MaxIdle, cfg.MaxActive, cfg.IdleTimeout, cfg.Serializer)
+
+	eq := &EmailQueueManager{
+		submitter:    celeryClient,
+		redisPool:    redisPool,
+		fallbackPool: fallbackPool,
+		amqpBroker:   amqpBroker,
+		redisBackend: redisBackend,
+		results:      redisResultBackend{redisBackend.Pool},
+		config:       cfg,
+		breaker:      newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}
+	// gocelery only builds protocol 1 JSON messages without headers
+	if cfg.Serializer != SerializerJSON || cfg.Protocol != ProtocolV1 || cfg.BatchID != "" || cfg.RoutingKey != "" || cfg.Exchange != "" || fallbackPool != nil {
+		eq.submitter = messageSubmitter{eq}
+	}
+	return eq, nil
+}
+
+// newRedisPool creates a Redis connection pool sized from the config. Unless
+// cfg.NoWait is set, Get blocks while cfg.MaxActive connections are in use so
+// high concurrency cannot exhaust the connections Redis allows.
+func newRedisPool(dialURL string, dialOptions []redis.DialOption, cfg Config) *redis.Pool {
+	maxActive := cfg.MaxActive
+	if maxActive < 0 {
+		maxActive = 0
+	}
+	return &redis.Pool{
+		MaxIdle:     cfg.MaxIdle,
+		MaxActive:   maxActive,
+		Wait:        !cfg.NoWait,
+		IdleTimeout: cfg.IdleTimeout,
+		Dial: func() (redis.Conn, error) {
+			start := time.Now()
+			conn, err := redis.DialURL(dialURL, dialOptions...)
+			if err != nil {
+				logDebug("redis_dial_failed", Fields{"url": RedactURL(dialURL), "error": err},
+					"🔗 Failed to dial Redis %s: %v", RedactURL(dialURL), err)
+			} else {
+				logDebug("redis_dial", Fields{"url": RedactURL(dialURL), "duration": time.Since(start).String()},
+					"🔗 Dialed Redis %s in %v", RedactURL(dialURL), time.Since(start).Round(time.Microsecond))
+			}
+			return conn, err
+		},
+	}
+}
+
+// RedactURL hides the password of a connection URL in logs
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// redisDialURL returns the URL and dial options used to connect to Redis.
+// DialURL chooses TLS from the scheme alone, so UseTLS upgrades redis:// to
+// rediss://. A password embedded in the URL takes precedence over
+// Config.Password.
+func redisDialURL(rawURL string, cfg Config) (string, []redis.DialOption, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return "", nil, fmt.Errorf("invalid Redis URL scheme: %s", u.Scheme)
+	}
+
+	if cfg.UseTLS {
+		u.Scheme = "rediss"
+	}
+
+	var dialOptions []redis.DialOption
+	if cfg.Password != "" {
+		dialOptions = append(dialOptions, redis.DialPassword(cfg.Password))
+	}
+
+	return u.String(), dialOptions, nil
+}
+
+// Close releases the Redis connections held by the broker and backend pools.
+// It is safe to call more than once.
+func (eq *EmailQueueManager) Close() {
+	eq.closeOnce.Do(func() {
+		if err := eq.redisPool.Close(); err != nil {
+			logWarn("close_failed", Fields{"error": err}, "⚠️  Failed to close Redis broker pool: %v", err)
+		}
+		if err := eq.redisBackend.Pool.Close(); err != nil {
+			logWarn("close_failed", Fields{"error": err}, "⚠️  Failed to close Redis backend pool: %v", err)
+		}
+		if eq.fallbackPool != nil {
+			if err := eq.fallbackPool.Close(); err != nil {
+				logWarn("close_failed", Fields{"error": err}, "⚠️  Failed to close fallback Redis broker pool: %v", err)
+			}
+		}
+		if eq.amqpBroker != nil {
+			if err := eq.amqpBroker.Close(); err != nil {
+				logWarn("close_failed", Fields{"error": err}, "⚠️  Failed to close AMQP broker connection: %v", err)
+			}
+		}
+		logInfo("client_closed", nil, "📋 Celery client closed")
+	})
+}
+
+// AddEmailToQueue adds an email filename to the Celery queue using gocelery
+// and returns the submitted task ID
+func (eq *EmailQueueManager) AddEmailToQueue(emailFilename string) (string, error) {
+	return eq.AddEmailToQueueAs(eq.config.TaskName, emailFilename)
+}
+
+// AddEmailToQueueContext adds an email filename to the Celery queue, giving up
+// with ctx.Err() if the context is done before Redis accepts the task. A
+// submission already in flight when the context ends may still land.
+func (eq *EmailQueueManager) AddEmailToQueueContext(ctx context.Context, emailFilename string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	type submitResult struct {
+		taskID string
+		err    error
+	}
+	done := make(chan submitResult, 1)
+
+	go func() {
+		taskID, err := eq.AddEmailToQueue(emailFilename)
+		done <- submitResult{taskID, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case result := <-done:
+		return result.taskID, result.err
+	}
+}
+
+// AddEmailToQueueAs adds an email filename to the Celery queue under the given
+// task name instead of the configured one
+func (eq *EmailQueueManager) AddEmailToQueueAs(taskName, emailFilename string) (string, error) {
+	if eq.skipDryRun(taskName, emailFilename) {
+		return "", nil
+	}
+
+	// Create task arguments
+	args := []interface{}{emailFilename}
+
+	// Submit task using gocelery client
+	asyncResult, err := eq.delay(taskName, args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	logInfo("email_queued", Fields{"filename": emailFilename, "task_id": asyncResult.TaskID},
+		"✅ Added email '%s' to queue with task ID: %s", emailFilename, asyncResult.TaskID)
+	return asyncResult.TaskID, nil
+}
+
+// AddEmailPayloadToQueue adds an email to the Celery queue with the whole
+// email object as the task argument instead of a filename, so the worker does
+// not need access to the producer's files
+func (eq *EmailQueueManager) AddEmailPayloadToQueue(email map[string]interface{}) (string, error) {
+	description := payloadDescription(email)
+	if eq.skipDryRun(eq.config.TaskName, description) {
+		return "", nil
+	}
+
+	asyncResult, err := eq.delay(eq.config.TaskName, email)
+	if err != nil {
+		return "", fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	logInfo("email_queued", Fields{"filename": description, "task_id": asyncResult.TaskID},
+		"✅ Added email %s to queue with task ID: %s", description, asyncResult.TaskID)
+	return asyncResult.TaskID, nil
+}
+
+// AddEmailToQueueArgs adds an email to the Celery queue with the given
+// positional task arguments, in order, for task signatures such as
+// process_email_task(filename, tenant, priority). The first argument names
+// the email in logs. At least one argument is required.
+func (eq *EmailQueueManager) AddEmailToQueueArgs(args ...interface{}) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("at least one task argument is required")
+	}
+
+	description := fmt.Sprint(args[0])
+	if eq.skipDryRun(eq.config.TaskName, description) {
+		return "", nil
+	}
+
+	asyncResult, err := eq.delay(eq.config.TaskName, args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	logInfo("email_queued", Fields{"filename": description, "task_id": asyncResult.TaskID, "args": len(args)},
+		"✅ Added email '%s' to queue with %d task arguments and task ID: %s", description, len(args), asyncResult.TaskID)
+	return asyncResult.TaskID, nil
+}
+
+// payloadDescription names an inline email payload in logs
+func payloadDescription(email map[string]interface{}) string {
+	return fmt.Sprintf("<payload: %v>", email["subject"])
+}
+
+// AddEmailToQueueWithRetry adds an email filename to the Celery queue, retrying
+// with exponential backoff (100ms doubling up to 5s) while the submission fails
+// with a Redis connection error. While Redis rejects the write because it is
+// out of memory (OOM) or still loading its dataset (LOADING), it backs off
+// longer (1s doubling up to 30s). Other errors are returned immediately.
+func (eq *EmailQueueManager) AddEmailToQueueWithRetry(emailFilename string, maxRetries int) (string, error) {
+	backoff := initialRetryBackoff
+	busyBackoff := initialBusyBackoff
+
+	for attempt := 0; ; attempt++ {
+		taskID, err := eq.AddEmailToQueue(emailFilename)
+		condition := redisBusyCondition(err)
+		if err == nil || (condition == "" && !isConnectionError(err)) || attempt >= maxRetries {
+			return taskID, err
+		}
+
+		if condition != "" {
+			logWarn("redis_busy", Fields{"filename": emailFilename, "attempt": attempt + 1, "condition": condition, "error": err},
+				"🐢 Redis reports %s, retrying '%s' in %v (attempt %d/%d): %v", condition, emailFilename, busyBackoff, attempt+1, maxRetries, err)
+			time.Sleep(busyBackoff)
+			busyBackoff = nextBackoff(busyBackoff, maxBusyBackoff)
+			continue
+		}
+
+		logWarn("submit_retry", Fields{"filename": emailFilename, "attempt": attempt + 1, "error": err},
+			"🔁 Retrying '%s' in %v (attempt %d/%d): %v", emailFilename, backoff, attempt+1, maxRetries, err)
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff, maxRetryBackoff)
+	}
+}
+
+// nextBackoff doubles backoff, capped at limit
+func nextBackoff(backoff, limit time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > limit {
+		backoff = limit
+	}
+	return backoff
+}
+
+// isConnectionError reports whether err comes from a broken or unreachable
+// Redis connection rather than from the task itself
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, redis.ErrPoolExhausted)
+}
+
+// redisBusyCondition returns "OOM" or "LOADING" when err is a Redis reply
+// rejecting the write because the server is out of memory or still loading
+// its dataset, and "" otherwise
+func redisBusyCondition(err error) string {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return ""
+	}
+	for _, condition := range []string{"OOM", "LOADING"} {
+		if strings.HasPrefix(string(redisErr), condition+" ") {
+			return condition
+		}
+	}
+	return ""
+}
+
+// AddEmailToQueueWithPriority adds an email filename to the Celery queue with the
+// given priority (0-9). The priority is set in the message delivery_info and the
+// task is pushed onto the kombu priority list for that step, so priorities 1-2
+// share a list with 0, 3-5 with 3, 6-8 with 6, and 9 has its own list.
+func (eq *EmailQueueManager) AddEmailToQueueWithPriority(emailFilename string, priority int) error {
+	if priority < 0 || priority > MaxPriority {
+		return fmt.Errorf("invalid priority %d: must be between 0 and %d", priority, MaxPriority)
+	}
+	if eq.skipDryRun(eq.config.TaskName, emailFilename) {
+		return nil
+	}
+
+	task := newTaskMessage(eq.config.TaskName, emailFilename)
+	if err := eq.sendTask(eq.config.QueueName, task, priority, nil); err != nil {
+		return fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	logInfo("email_queued", Fields{"filename": emailFilename, "task_id": task.ID, "priority": priority},
+		"✅ Added email '%s' to queue with task ID: %s (priority %d)", emailFilename, task.ID, priority)
+	return nil
+}
+
+// AddEmailToQueueAt adds an email filename to the Celery queue with an ETA so
+// workers do not execute the task before the given time. An ETA in the past is
+// submitted for immediate execution.
+func (eq *EmailQueueManager) AddEmailToQueueAt(emailFilename string, eta time.Time) error {
+	_, err := eq.addEmailWithETA(emailFilename, eta)
+	return err
+}
+
+// addEmailWithETA submits an email filename with an ETA and returns its task ID
+func (eq *EmailQueueManager) addEmailWithETA(emailFilename string, eta time.Time) (string, error) {
+	if eq.skipDryRun(eq.config.TaskName, emailFilename) {
+		return "", nil
+	}
+
+	task := newTaskMessage(eq.config.TaskName, emailFilename)
+
+	if eta.After(time.Now()) {
+		etaString := eta.UTC().Format(time.RFC3339Nano)
+		task.ETA = &etaString
+	} else {
+		logWarn("eta_in_past", Fields{"filename": emailFilename, "eta": eta.Format(time.RFC3339)},
+			"⚠️  ETA %s for '%s' is in the past, queuing for immediate execution", eta.Format(time.RFC3339), emailFilename)
+	}
+
+	if err := eq.sendTask(eq.config.QueueName, task, 0, nil); err != nil {
+		return "", fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	if task.ETA != nil {
+		logInfo("email_queued", Fields{"filename": emailFilename, "task_id": task.ID, "eta": *task.ETA},
+			"✅ Added email '%s' to queue with task ID: %s (eta %s)", emailFilename, task.ID, *task.ETA)
+	} else {
+		logInfo("email_queued", Fields{"filename": emailFilename, "task_id": task.ID},
+			"✅ Added email '%s' to queue with task ID: %s", emailFilename, task.ID)
+	}
+	return task.ID, nil
+}
+
+// AddEmailToQueueAfter adds an email filename to the Celery queue so workers
+// pick it up once the given delay has elapsed
+func (eq *EmailQueueManager) AddEmailToQueueAfter(emailFilename string, delay time.Duration) error {
+	_, err := eq.AddEmailToQueueWithCountdown(emailFilename, delay)
+	return err
+}
+
+// AddEmailToQueueWithCountdown adds an email filename to the Celery queue and
+// returns its task ID; workers execute the task once countdown has elapsed.
+// Like Celery's apply_async(countdown=...), the countdown is sent as an ETA of
+// now plus countdown, so the message is on the queue immediately and the
+// worker holds it back. This differs from RunOptions.Delay (--submit-delay),
+// which sleeps in the producer between submissions. A zero countdown queues
+// the task for immediate execution.
+func (eq *EmailQueueManager) AddEmailToQueueWithCountdown(emailFilename string, countdown time.Duration) (string, error) {
+	if countdown < 0 {
+		return "", fmt.Errorf("invalid countdown %v: must not be negative", countdown)
+	}
+
+	if countdown == 0 {
+		return eq.AddEmailToQueue(emailFilename)
+	}
+
+	return eq.addEmailWithETA(emailFilename, time.Now().Add(countdown))
+}
+
+// AddEmailToQueueWithExpiry adds an email filename to the Celery queue with
+// Celery's expires option and returns its task ID. Workers that receive the
+// task after expires revoke it instead of processing a stale email. The
+// expiry must be in the future.
+func (eq *EmailQueueManager) AddEmailToQueueWithExpiry(emailFilename string, expires time.Time) (string, error) {
+	if !expires.After(time.Now()) {
+		return "", fmt.Errorf("invalid expiry %s: must be in the future", expires.Format(time.RFC3339))
+	}
+	if eq.skipDryRun(eq.config.TaskName, emailFilename) {
+		return "", nil
+	}
+
+	task := newTaskMessage(eq.config.TaskName, emailFilename)
+	expiresUTC := expires.UTC()
+	task.Expires = &expiresUTC
+
+	if err := eq.sendTask(eq.config.QueueName, task, 0, nil); err != nil {
+		return "", fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	logInfo("email_queued", Fields{"filename": emailFilename, "task_id": task.ID, "expires": expiresUTC.Format(time.RFC3339Nano)},
+		"✅ Added email '%s' to queue with task ID: %s (expires %s)", emailFilename, task.ID, expiresUTC.Format(time.RFC3339))
+	return task.ID, nil
+}
+
+// AddEmailToQueueWithMeta adds an email filename to the Celery queue with meta
+// attached as task kwargs, so the worker task receives them as keyword
+// arguments. The same entries are set as message headers for middleware that
+// routes on the raw message without decoding the body. Values must be JSON
+// encodable.
+func (eq *EmailQueueManager) AddEmailToQueueWithMeta(emailFilename string, meta map[string]interface{}) (string, error) {
+	if eq.skipDryRun(eq.config.TaskName, emailFilename) {
+		return "", nil
+	}
+
+	task := newTaskMessage(eq.config.TaskName, emailFilename)
+	headers := make(map[string]interface{}, len(meta))
+	for key, value := range meta {
+		task.Kwargs[key] = value
+		headers[key] = value
+	}
+
+	if err := eq.sendTask(eq.config.QueueName, task, 0, headers); err != nil {
+		return "", fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	logInfo("email_queued", Fields{"filename": emailFilename, "task_id": task.ID, "meta": meta},
+		"✅ Added email '%s' to queue with task ID: %s (meta %v)", emailFilename, task.ID, meta)
+	return task.ID, nil
+}
+
+// AddEmailToQueueRouted adds an email filename to one of the configured
+// Queues, chosen by the Routing strategy, and returns the queue and task ID.
+// Without Queues every email goes to QueueName.
+func (eq *EmailQueueManager) AddEmailToQueueRouted(emailFilename string) (queueName, taskID string, err error) {
+	queueName = eq.routeQueue(emailFilename)
+	if eq.skipDryRun(eq.config.TaskName, emailFilename) {
+		return queueName, "", nil
+	}
+
+	task := newTaskMessage(eq.config.TaskName, emailFilename)
+	if err := eq.sendTask(queueName, task, 0, nil); err != nil {
+		return queueName, "", fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	logInfo("email_queued", Fields{"filename": emailFilename, "task_id": task.ID, "queue_name": queueName},
+		"✅ Added email '%s' to queue '%s' with task ID: %s", emailFilename, queueName, task.ID)
+	return queueName, task.ID, nil
+}
+
+// QueueNames returns the queues tasks may be submitted to
+func (eq *EmailQueueManager) QueueNames() []string {
+	if len(eq.config.Queues) > 0 {
+		return eq.config.Queues
+	}
+	return []string{eq.config.QueueName}
+}
+
+// routeQueue picks the queue for an email according to the routing strategy
+func (eq *EmailQueueManager) routeQueue(emailFilename string) string {
+	queues := eq.QueueNames()
+	if eq.config.Routing == RouteHash {
+		h := fnv.New32a()
+		h.Write([]byte(emailFilename))
+		return queues[h.Sum32()%uint32(len(queues))]
+	}
+	return queues[(eq.nextQueue.Add(1)-1)%uint64(len(queues))]
+}
+
+// batchIDHeader is the message header carrying Config.BatchID
+const batchIDHeader = "batch_id"
+
+// BatchID returns the batch ID sent with every task, or "" when there is none
+func (eq *EmailQueueManager) BatchID() string {
+	return eq.config.BatchID
+}
+
+// newTaskMessage builds a Celery task message with a fresh task ID
+func newTaskMessage(taskName string, args ...interface{}) *gocelery.TaskMessage {
+	return &gocelery.TaskMessage{
+		ID:     uuid.Must(uuid.NewV4()).String(),
+		Task:   taskName,
+		Args:   args,
+		Kwargs: map[string]interface{}{},
+	}
+}
+
+// sendTask encodes a task message and pushes it onto the Redis list kombu
+// reads for the given queue and priority, with optional message headers. With
+// an AMQP broker it publishes to the queue with the priority as the AMQP
+// message priority instead. With ProtocolV2 the task fields move into the
+// headers, next to the given ones. Config.BatchID is added as the batch_id
+// header.
+func (eq *EmailQueueManager) sendTask(queueName string, task *gocelery.TaskMessage, priority int, headers map[string]interface{}) error {
+	message, err := eq.celeryMessage(queueName, task, priority, headers)
+	if err != nil {
+		return err
+	}
+
+	if err := eq.breaker.allow(); err != nil {
+		return err
+	}
+	err = eq.publishMessage(queueName, priority, task.ID, message)
+	eq.breaker.record(err)
+	return err
+}
+
+// celeryMessage encodes task as the message sendTask pushes
+func (eq *EmailQueueManager) celeryMessage(queueName string, task *gocelery.TaskMessage, priority int, headers map[string]interface{}) (*gocelery.CeleryMessage, error) {
+	if eq.config.BatchID != "" {
+		withBatch := make(map[string]interface{}, len(headers)+1)
+		for key, value := range headers {
+			withBatch[key] = value
+		}
+		withBatch[batchIDHeader] = eq.config.BatchID
+		headers = withBatch
+	}
+
+	var encodedTask string
+	var err error
+	if eq.config.Protocol == ProtocolV2 {
+		protocolHeaders := taskHeadersV2(task)
+		for key, value := range headers {
+			if _, reserved := protocolHeaders[key]; !reserved {
+				protocolHeaders[key] = value
+			}
+		}
+		headers = protocolHeaders
+		encodedTask, err = encodeBody(taskBodyV2(task), eq.config.Serializer)
+	} else {
+		encodedTask, err = encodeTask(task, eq.config.Serializer)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode task: %v", err)
+	}
+
+	return &gocelery.CeleryMessage{
+		Body:        encodedTask,
+		Headers:     headers,
+		ContentType: eq.config.Serializer.contentType(),
+		Properties: gocelery.CeleryProperties{
+			BodyEncoding:  "base64",
+			CorrelationID: task.ID,
+			ReplyTo:       uuid.Must(uuid.NewV4()).String(),
+			DeliveryInfo: gocelery.CeleryDeliveryInfo{
+				Priority:   priority,
+				RoutingKey: eq.routingKey(queueName),
+				Exchange:   eq.exchange(queueName),
+			},
+			DeliveryMode: 2,
+			DeliveryTag:  uuid.Must(uuid.NewV4()).String(),
+		},
+		ContentEncoding: "utf-8",
+	}, nil
+}
+
+// publishMessage publishes an encoded message to the AMQP broker or pushes it
+// onto the Redis broker
+func (eq *EmailQueueManager) publishMessage(queueName string, priority int, taskID string, message *gocelery.CeleryMessage) error {
+	if eq.amqpBroker != nil {
+		return eq.amqpBroker.publish(queueName, message)
+	}
+	return eq.pushMessage(queueName, priority, taskID, message)
+}
+
+// messageSubmitter is the TaskSubmitter of configurations gocelery cannot
+// encode: other serializers and protocols, the batch_id header, a custom
+// routing key or exchange and a fallback broker. It builds the message like
+// sendTask and submits it to Config.QueueName.
+type messageSubmitter struct {
+	eq *EmailQueueManager
+}
+
+// Delay encodes and publishes a task message with a fresh task ID
+func (s messageSubmitter) Delay(taskName string, args ...interface{}) (*gocelery.AsyncResult, error) {
+	task := newTaskMessage(taskName, args...)
+	message, err := s.eq.celeryMessage(s.eq.config.QueueName, task, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.eq.publishMessage(s.eq.config.QueueName, 0, task.ID, message); err != nil {
+		return nil, err
+	}
+	return &gocelery.AsyncResult{TaskID: task.ID}, nil
+}
+
+// routingKey returns the routing key of messages for queueName: Config.RoutingKey
+// when set, otherwise the queue name as Celery uses by default
+func (eq *EmailQueueManager) routingKey(queueName string) string {
+	if eq.config.RoutingKey != "" {
+		return eq.config.RoutingKey
+	}
+	return queueName
+}
+
+// exchange returns the exchange of messages for queueName: Config.Exchange
+// when set, otherwise the queue name as Celery uses by default
+func (eq *EmailQueueManager) exchange(queueName string) string {
+	if eq.config.Exchange != "" {
+		return eq.config.Exchange
+	}
+	return queueName
+}
+
+// pushMessage pushes an encoded message onto the Redis broker. When the
+// primary fails with a connection error and FallbackRedisURL is set, the
+// message is pushed onto the fallback instead, and the submission only fails
+// if both do.
+func (eq *EmailQueueManager) pushMessage(queueName string, priority int, taskID string, message *gocelery.CeleryMessage) error {
+	listName := priorityQueueName(queueName, priority)
+	broker := &gocelery.RedisCeleryBroker{Pool: eq.redisPool, QueueName: listName}
+	err := broker.SendCeleryMessage(message)
+	if err == nil {
+		logDebug("task_pushed", Fields{"task_id": taskID, "broker": "primary"}, "📮 Task %s pushed to the primary broker", taskID)
+		return nil
+	}
+	if eq.fallbackPool == nil || !isConnectionError(err) {
+		return err
+	}
+
+	fallback := &gocelery.RedisCeleryBroker{Pool: eq.fallbackPool, QueueName: listName}
+	if fallbackErr := fallback.SendCeleryMessage(message); fallbackErr != nil {
+		return fmt.Errorf("primary broker: %w; fallback broker: %v", err, fallbackErr)
+	}
+	logWarn("fallback_broker", Fields{"task_id": taskID, "broker": "fallback", "url": RedactURL(eq.config.FallbackRedisURL), "error": err},
+		"🔀 Primary broker unreachable, task %s pushed to the fallback broker %s: %v", taskID, RedactURL(eq.config.FallbackRedisURL), err)
+	return nil
+}
+
+// delay submits a task through the TaskSubmitter, guarded by the circuit
+// breaker. The submitter is the gocelery client, or a messageSubmitter for
+// the configurations gocelery does not support.
+func (eq *EmailQueueManager) delay(taskName string, args ...interface{}) (*gocelery.AsyncResult, error) {
+	if err := eq.breaker.allow(); err != nil {
+		return nil, err
+	}
+	asyncResult, err := eq.submitter.Delay(taskName, args...)
+	eq.breaker.record(err)
+	return asyncResult, err
+}
+
+// CircuitState reports the state of the submission circuit breaker. It is
+// always CircuitClosed when BreakerThreshold is not set.
+func (eq *EmailQueueManager) CircuitState() CircuitState {
+	return eq.breaker.State()
+}
+
+// priorityQueueName returns the Redis list kombu reads for the given priority
+func priorityQueueName(queueName string, priority int) string {
+	step := redisPrioritySteps[0]
+	for _, s := range redisPrioritySteps {
+		if priority >= s {
+			step = s
+		}
+	}
+
+	if step == 0 {
+		return queueName
+	}
+	return fmt.Sprintf("%s\x06\x16%d", queueName, step)
+}
+
+// skipDryRun logs the task that would be submitted and reports whether the
+// manager is in dry-run mode, in which case the caller must not submit it
+func (eq *EmailQueueManager) skipDryRun(taskName, emailFilename string) bool {
+	if !eq.config.DryRun {
+		return false
+	}
+
+	logInfo("dry_run", Fields{"filename": emailFilename, "task_name": taskName},
+		"🧪 Dry run: would add email '%s' to queue '%s' as %s", emailFilename, eq.config.QueueName, taskName)
+	return true
+}
+
+// AddEmailsToQueue submits a batch of email filenames and returns their task IDs
+// in the same order as the input. Each entry is submitted on its own, like
+// AddEmailToQueue. Submission continues past failures; failed entries
+// get an empty task ID and are listed in the returned error. In dry-run mode
+// every entry gets an empty task ID and no error.
+func (eq *EmailQueueManager) AddEmailsToQueue(filenames []string) ([]string, error) {
+	taskIDs := make([]string, len(filenames))
+	var failures []string
+
+	for i, emailFilename := range filenames {
+		if eq.skipDryRun(eq.config.TaskName, emailFilename) {
+			continue
+		}
+
+		asyncResult, err := eq.delay(eq.config.TaskName, emailFilename)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s (%v)", emailFilename, err))
+			continue
+		}
+
+		taskIDs[i] = asyncResult.TaskID
+		logInfo("email_queued", Fields{"filename": emailFilename, "task_id": asyncResult.TaskID},
+			"✅ Added email '%s' to queue with task ID: %s", emailFilename, asyncResult.TaskID)
+	}
+
+	if len(failures) > 0 {
+		return taskIDs, fmt.Errorf("failed to submit %d of %d tasks: %s", len(failures), len(filenames), strings.Join(failures, ", "))
+	}
+
+	return taskIDs, nil
+}
+
+// queueListNames returns every Redis list backing the configured queues,
+// including the kombu priority lists
+func (eq *EmailQueueManager) queueListNames() []string {
+	var listNames []string
+	for _, queueName := range eq.QueueNames() {
+		for _, step := range redisPrioritySteps {
+			listNames = append(listNames, priorityQueueName(queueName, step))
+		}
+	}
+	return listNames
+}
+
+// QueueDepth returns the number of tasks pending in the configured queues,
+// summed across their priority lists
+func (eq *EmailQueueManager) QueueDepth() (int, error) {
+	if eq.amqpBroker != nil {
+		depth := 0
+		for _, queueName := range eq.QueueNames() {
+			n, err := eq.amqpBroker.queueDepth(queueName)
+			if err != nil {
+				return 0, fmt.Errorf("failed to get depth of queue %s: %v", queueName, err)
+			}
+			depth += n
+		}
+		return depth, nil
+	}
+
+	conn := eq.redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, listName := range eq.queueListNames() {
+		conn.Send("LLEN", listName)
+	}
+
+	lengths, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get depth of queue %s: %v", strings.Join(eq.QueueNames(), ", "), err)
+	}
+
+	depth := 0
+	for _, length := range lengths {
+		depth += length
+	}
+	return depth, nil
+}
+
+// HealthCheck sends a PING over a pooled Redis connection and returns the
+// round-trip latency, including the time to dial a new connection. With an
+// AMQP broker it checks that a channel to the broker can be opened instead.
+func (eq *EmailQueueManager) HealthCheck() (time.Duration, error) {
+	start := time.Now()
+	if eq.amqpBroker != nil {
+		if err := eq.amqpBroker.ping(); err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+
+	conn := eq.redisPool.Get()
+	defer conn.Close()
+
+	reply, err := redis.String(conn.Do("PING"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to ping Redis: %v", err)
+	}
+	if reply != "PONG" {
+		return 0, fmt.Errorf("unexpected PING reply: %q", reply)
+	}
+	return time.Since(start), nil
+}
+
+// PurgeQueue deletes all pending tasks in the configured queues, including
+// their priority lists, and returns how many tasks were removed. It is destructive
+// and is never called implicitly.
+func (eq *EmailQueueManager) PurgeQueue() (int, error) {
+	if eq.amqpBroker != nil {
+		removed := 0
+		for _, queueName := range eq.QueueNames() {
+			n, err := eq.amqpBroker.purge(queueName)
+			if err != nil {
+				return removed, fmt.Errorf("failed to purge queue %s: %v", queueName, err)
+			}
+			removed += n
+		}
+		return removed, nil
+	}
+
+	conn := eq.redisPool.Get()
+	defer conn.Close()
+
+	listNames := eq.queueListNames()
+	conn.Send("MULTI")
+	for _, listName := range listNames {
+		conn.Send("LLEN", listName)
+	}
+	for _, listName := range listNames {
+		conn.Send("DEL", listName)
+	}
+
+	replies, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge queue %s: %v", strings.Join(eq.QueueNames(), ", "), err)
+	}
+
+	removed := 0
+	for _, length := range replies[:len(listNames)] {
+		removed += length
+	}
+	return removed, nil
+}
+
+// TaskInfo describes a task waiting in a queue
+type TaskInfo struct {
+	Queue string        `json:"queue"`
+	ID    string        `json:"id"`
+	Task  string        `json:"task"`
+	Args  []interface{} `json:"args"`
+}
+
+// ListPendingTasks returns up to limit tasks waiting in the configured queues,
+// in the order workers receive them: higher priority lists first and, within
+// a list, oldest first. A limit of 0 or less lists every task. Messages that
+// cannot be decoded are skipped with a warning. Listing needs a Redis broker,
+// as AMQP cannot show messages without consuming them.
+func (eq *EmailQueueManager) ListPendingTasks(limit int) ([]TaskInfo, error) {
+	if eq.amqpBroker != nil {
+		return nil, errors.New("listing pending tasks is not supported with an AMQP broker")
+	}
+
+	conn := eq.redisPool.Get()
+	defer conn.Close()
+
+	tasks := []TaskInfo{}
+	for _, queueName := range eq.QueueNames() {
+		for _, step := range redisPrioritySteps {
+			listName := priorityQueueName(queueName, step)
+			remaining := limit - len(tasks)
+			if limit > 0 && remaining <= 0 {
+				return tasks, nil
+			}
+
+			// Messages are LPUSHed and workers pop from the tail, so the
+			// oldest message is last
+			start := 0
+			if limit > 0 {
+				start = -remaining
+			}
+			messages, err := redis.ByteSlices(conn.Do("LRANGE", listName, start, -1))
+			if err != nil {
+				return nil, fmt.Errorf("failed to list queue %s: %v", queueName, err)
+			}
+
+			for i := len(messages) - 1; i >= 0; i-- {
+				task, err := decodeCeleryMessage(messages[i])
+				if err != nil {
+					logWarn("task_decode_failed", Fields{"queue_name": queueName, "error": err},
+						"⚠️  Skipping undecodable message in queue '%s': %v", queueName, err)
+					continue
+				}
+				tasks = append(tasks, TaskInfo{Queue: queueName, ID: task.ID, Task: task.Task, Args: task.Args})
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// decodeCeleryMessage extracts the task from a message as stored in a Redis queue
+func decodeCeleryMessage(data []byte) (*gocelery.TaskMessage, error) {
+	var message gocelery.CeleryMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	if message.Properties.BodyEncoding != "base64" {
+		return nil, fmt.Errorf("unsupported body encoding %q", message.Properties.BodyEncoding)
+	}
+	// Protocol 2 messages name the task in their headers
+	if _, ok := message.Headers["task"].(string); ok {
+		task, err := decodeTaskV2(message.Headers, message.Body, message.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid task body: %v", err)
+		}
+		return task, nil
+	}
+	task, err := decodeTask(message.Body, message.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid task body: %v", err)
+	}
+	return task, nil
+}
+
+// FilenameHash returns the SHA-256 of an email filename, used as its member in
+// the idempotency set
+func FilenameHash(emailFilename string) string {
+	sum := sha256.Sum256([]byte(emailFilename))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsSubmitted reports whether the hash is a member of the Redis set at setKey
+func (eq *EmailQueueManager) IsSubmitted(setKey, hash string) (bool, error) {
+	conn := eq.redisPool.Get()
+	defer conn.Close()
+
+	submitted, err := redis.Bool(conn.Do("SISMEMBER", setKey, hash))
+	if err != nil {
+		return false, fmt.Errorf("failed to check idempotency set %s: %v", setKey, err)
+	}
+	return submitted, nil
+}
+
+// MarkSubmitted adds the hash to the Redis set at setKey
+func (eq *EmailQueueManager) MarkSubmitted(setKey, hash string) error {
+	conn := eq.redisPool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SADD", setKey, hash); err != nil {
+		return fmt.Errorf("failed to update idempotency set %s: %v", setKey, err)
+	}
+	return nil
+}
+
+// taskIDNamespace is the UUIDv5 namespace for task IDs derived from filenames
+var taskIDNamespace = uuid.NewV5(uuid.NamespaceURL, "go-email-queue/task-id")
+
+// DeterministicTaskID returns the task ID derived from the filename hash, so
+// every run submits a given email under the same ID
+func DeterministicTaskID(emailFilename string) string {
+	return uuid.NewV5(taskIDNamespace, FilenameHash(emailFilename)).String()
+}
+
+// AddEmailToQueueWithID adds an email filename to the Celery queue under the
+// given task ID instead of a random one, e.g. DeterministicTaskID(filename),
+// so re-runs submit the email under the same ID. It returns the task ID.
+func (eq *EmailQueueManager) AddEmailToQueueWithID(emailFilename, taskID string) (string, error) {
+	if taskID == "" {
+		return "", errors.New("task ID must not be empty")
+	}
+	return eq.addTask(taskID, emailFilename, emailFilename, nil)
+}
+
+// IsCompleted reports whether the result backend holds a SUCCESS result for
+// the task. A missing result means the task has not completed.
+func (eq *EmailQueueManager) IsCompleted(taskID string) (bool, error) {
+	conn := eq.redisBackend.Pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", "celery-task-meta-"+taskID))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up result for %s: %v", taskID, err)
+	}
+
+	var result gocelery.ResultMessage
+	if err := json.Unmarshal(data, &result); err != nil {
+		return false, fmt.Errorf("invalid result for %s: %v", taskID, err)
+	}
+	return result.Status == "SUCCESS", nil
+}
+
+// addTask submits a task to the queue picked by the routing strategy, with
+// optional message headers and a caller-chosen ID; an empty taskID gets a
+// fresh one. description names the email in logs.
+func (eq *EmailQueueManager) addTask(taskID, description string, arg interface{}, headers map[string]interface{}) (string, error) {
+	return eq.addTaskTo(eq.routeQueue(description), taskID, description, arg, headers)
+}
+
+// addTaskTo is addTask for a queue the caller already picked
+func (eq *EmailQueueManager) addTaskTo(queueName, taskID, description string, arg interface{}, headers map[string]interface{}) (string, error) {
+	if eq.skipDryRun(eq.config.TaskName, description) {
+		return "", nil
+	}
+
+	task := newTaskMessage(eq.config.TaskName, arg)
+	if taskID != "" {
+		task.ID = taskID
+	}
+	if err := eq.sendTask(queueName, task, 0, headers); err != nil {
+		return "", fmt.Errorf("failed to submit task: %w", err)
+	}
+
+	logInfo("email_queued", Fields{"filename": description, "task_id": task.ID},
+		"✅ Added email '%s' to queue with task ID: %s", description, task.ID)
+	return task.ID, nil
+}
+
+// WaitForResult blocks until the task finishes or the timeout elapses and returns
+// the decoded result payload. It polls the result backend the same way
+// AsyncResult.Get does, since an AsyncResult can only be obtained from Delay,
+// but returns as soon as the task reports a failure instead of waiting out the
+// timeout. The backend is read at least once, so a finished task is returned
+// even with a zero timeout, and backend errors other than a missing result
+// are returned straight away rather than waited out.
+func (eq *EmailQueueManager) WaitForResult(taskID string, timeout time.Duration) (interface{}, error) {
+	ticker := time.NewTicker(resultPollInterval)
+	defer ticker.Stop()
+	timeoutChan := time.After(timeout)
+
+	for {
+		result, err := eq.results.GetResult(taskID)
+		switch {
+		case errors.Is(err, errResultPending):
+		case err != nil:
+			return nil, fmt.Errorf("failed to get result for %s: %w", taskID, err)
+		case result.Status == "SUCCESS":
+			return result.Result, nil
+		case result.Status == "FAILURE" || result.Status == "REVOKED":
+			return nil, fmt.Errorf("task %s finished with status %s: %v", taskID, result.Status, result.Result)
+		}
+
+		select {
+		case <-timeoutChan:
+			return nil, fmt.Errorf("%v timeout getting result for %s", timeout, taskID)
+		case <-ticker.C:
+		}
+	}
+}
+
+// DrainResults waits concurrently for the results of taskIDs and returns the
+// result payload of each task that succeeded, keyed by task ID. Each task is
+// waited for up to timeout as WaitForResult does, counted from when its
+// polling starts, with at most MaxActive tasks polled at once. Tasks that
+// failed, could not be read or are still pending after their timeout are left
+// out of the map and listed in the returned error, so partial results are
+// returned alongside it.
+func (eq *EmailQueueManager) DrainResults(taskIDs []string, timeout time.Duration) (map[string]interface{}, error) {
+	workers := eq.config.MaxActive
+	if workers <= 0 || workers > len(taskIDs) {
+		workers = len(taskIDs)
+	}
+
+	var mu sync.Mutex
+	results := make(map[string]interface{}, len(taskIDs))
+	var failures []string
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for taskID := range jobs {
+				result, err := eq.WaitForResult(taskID, timeout)
+				mu.Lock()
+				if err != nil {
+					failures = append(failures, err.Error())
+				} else {
+					results[taskID] = result
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, taskID := range taskIDs {
+		jobs <- taskID
+	}
+	close(jobs)
+	wg.Wait()
+
+	logInfo("results_drained", Fields{"count": len(taskIDs), "succeeded": len(results), "failed": len(failures)},
+		"📬 Drained %d of %d task results", len(results), len(taskIDs))
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return results, fmt.Errorf("failed to drain %d of %d results: %s", len(failures), len(taskIDs), strings.Join(failures, ", "))
+	}
+	return results, nil
+}
+
+// DefaultFilePrefix is the filename prefix that marks email files (as opposed
+// to summary files) in the test_data directory
+const DefaultFilePrefix = "email_"
+
+// ScanOptions controls which files GetEmailFilesWithOptions picks up
+type ScanOptions struct {
+	Prefix       string    // Only include files whose name starts with this prefix; empty includes all
+	IncludeYAML  bool      // Also include .yaml and .yml email files
+	IncludeGzip  bool      // Also include gzip-compressed .json.gz email files
+	NonRecursive bool      // Only scan the top-level directory, not its subdirectories
+	Sort         SortOrder // Order of the returned files (default: SortByName)
+	Since        time.Time // Skip files last modified before this time, for incremental runs; zero includes all
+}
+
+// SortOrder selects the order in which email files are queued
+type SortOrder string
+
+const (
+	// SortByName orders files lexically by their path relative to the data directory
+	SortByName SortOrder = "name"
+	// SortByModTime orders files from oldest to newest modification time,
+	// breaking ties by name
+	SortByModTime SortOrder = "mtime"
+)
+
+// ParseSortOrder validates a --sort value
+func ParseSortOrder(value string) (SortOrder, error) {
+	switch order := SortOrder(value); order {
+	case "", SortByName:
+		return SortByName, nil
+	case SortByModTime:
+		return order, nil
+	}
+	return "", fmt.Errorf("invalid sort order %q: must be %s or %s", value, SortByName, SortByModTime)
+}
+
+// DefaultScanOptions returns the options used by GetEmailFiles
+func DefaultScanOptions() ScanOptions {
+	return ScanOptions{
+		Prefix: DefaultFilePrefix,
+	}
+}
+
+// GetEmailFiles returns all JSON email files from the test_data directory
+func GetEmailFiles(testDataDir string) ([]string, error) {
+	return GetEmailFilesWithOptions(testDataDir, DefaultScanOptions())
+}
+
+// GetEmailFilesNonRecursive returns the JSON email files directly inside the
+// test_data directory, ignoring subdirectories
+func GetEmailFilesNonRecursive(testDataDir string) ([]string, error) {
+	opts := DefaultScanOptions()
+	opts.NonRecursive = true
+	return GetEmailFilesWithOptions(testDataDir, opts)
+}
+
+// GetEmailFilesWithOptions returns the email files from the test_data directory
+// that match the given scan options. Names are relative to testDataDir, so files
+// in subdirectories keep their subdirectory prefix and cannot collide.
+func GetEmailFilesWithOptions(testDataDir string, opts ScanOptions) ([]string, error) {
+	emailFiles, _, err := scanEmailFiles(testDataDir, opts)
+	return emailFiles, err
+}
+
+// scanEmailFiles walks testDataDir like GetEmailFilesWithOptions and also
+// returns how many matching files were skipped as modified before opts.Since
+func scanEmailFiles(testDataDir string, opts ScanOptions) ([]string, int, error) {
+	var emailFiles []string
+	stale := 0
+
+	err := filepath.Walk(testDataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if opts.NonRecursive && path != testDataDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Only include email files (not summary files)
+		if isEmailFileExtension(info.Name(), opts) && strings.HasPrefix(info.Name(), opts.Prefix) {
+			if info.ModTime().Before(opts.Since) {
+				stale++
+				return nil
+			}
+			relPath, err := filepath.Rel(testDataDir, path)
+			if err != nil {
+				return err
+			}
+			emailFiles = append(emailFiles, relPath)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read test_data directory: %v", err)
+	}
+
+	if err := sortEmailFiles(testDataDir, emailFiles, opts.Sort); err != nil {
+		return nil, 0, err
+	}
+	return emailFiles, stale, nil
+}
+
+// sortEmailFiles sorts files, given relative to dir, in place so runs queue
+// emails in a reproducible order
+func sortEmailFiles(dir string, files []string, order SortOrder) error {
+	if order != SortByModTime {
+		sort.Strings(files)
+		return nil
+	}
+
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(dir, file))
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		ti, tj := modTimes[files[i]], modTimes[files[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return files[i] < files[j]
+	})
+	return nil
+}
+
+// GetEmailFilesByGlob returns the email files matching a glob pattern such as
+// "test_data/2024-*/email_*.json". Directories and files with extensions that
+// ValidateEmailFile cannot parse are skipped.
+func GetEmailFilesByGlob(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob pattern %q: %v", pattern, err)
+	}
+
+	var emailFiles []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %v", match, err)
+		}
+
+		if info.IsDir() || !isEmailFileExtension(match, ScanOptions{IncludeYAML: true, IncludeGzip: true}) {
+			continue
+		}
+		emailFiles = append(emailFiles, match)
+	}
+
+	return emailFiles, nil
+}
+
+// ReadFileList reads newline-separated email file paths from r, skipping
+// blank lines
+func ReadFileList(r io.Reader) ([]string, error) {
+	files := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file list: %v", err)
+	}
+	return files, nil
+}
+
+// relativeToDir rewrites paths relative to dir, which is how the worker
+// resolves queued filenames
+func relativeToDir(paths []string, dir string) ([]string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	relPaths := make([]string, 0, len(paths))
+	for _, path := range paths {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+
+		relPath, err := filepath.Rel(absDir, absPath)
+		if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is outside %s", path, dir)
+		}
+		relPaths = append(relPaths, relPath)
+	}
+	return relPaths, nil
+}
+
+// isEmailFileExtension reports whether the file extension is one the scan accepts
+func isEmailFileExtension(name string, opts ScanOptions) bool {
+	if strings.EqualFold(filepath.Ext(name), ".gz") {
+		return opts.IncludeGzip && strings.EqualFold(filepath.Ext(strings.TrimSuffix(name, filepath.Ext(name))), ".json")
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return true
+	case ".yaml", ".yml":
+		return opts.IncludeYAML
+	}
+	return false
+}
+
+// DefaultMaxContentBytes is the content size limit applied by ValidateEmailFile
+const DefaultMaxContentBytes = 5 * 1024 * 1024
+
+// DefaultContentField is the field holding an email's HTML body
+const DefaultContentField = "html_content"
+
+// DefaultMaxFileBytes is the email file size limit applied by ValidateEmailFile;
+// it leaves headroom over DefaultMaxContentBytes for the other fields
+const DefaultMaxFileBytes = 16 * 1024 * 1024
+
+// DefaultReadTimeout bounds reading an email file in ValidateEmailFile, so a
+// stalled network filesystem fails the email instead of blocking the run
+const DefaultReadTimeout = 10 * time.Second
+
+// ValidationOptions tunes the checks run by ValidateEmailFileWithOptions
+type ValidationOptions struct {
+	MaxContentBytes  int                // Maximum content size in bytes; 0 disables the check
+	ContentField     string             // Required field holding the HTML body (default: html_content)
+	Schema           *jsonschema.Schema // When set, replaces the built-in field checks
+	Strict           bool               // Also validate the optional to and date fields when present
+	MaxFileBytes     int64              // Maximum email file size on disk, checked before reading; 0 disables the check
+	ReadTimeout      time.Duration      // Maximum time to stat and read an email file; 0 disables the timeout
+	RequireHTML      bool               // Reject content with no HTML tags, such as plain text
+	Attachments      bool               // Validate the entries of the optional attachments array
+	MaxSubjectLength int                // Maximum subject length in characters; 0 disables the check
+	Validators       []Validator        // Extra checks run in order after the built-in ones
+}
+
+// contentField returns the configured content field, defaulting to html_content
+func (opts ValidationOptions) contentField() string {
+	if opts.ContentField == "" {
+		return DefaultContentField
+	}
+	return opts.ContentField
+}
+
+// DefaultValidationOptions returns the options used by ValidateEmailFile
+func DefaultValidationOptions() ValidationOptions {
+	return ValidationOptions{
+		MaxContentBytes: DefaultMaxContentBytes,
+		ContentField:    DefaultContentField,
+		MaxFileBytes:    DefaultMaxFileBytes,
+		ReadTimeout:     DefaultReadTimeout,
+	}
+}
+
+// ValidateEmailFile validates that an email file has the required structure
+func ValidateEmailFile(filePath string) error {
+	return ValidateEmailFileWithOptions(filePath, DefaultValidationOptions())
+}
+
+// ValidateEmailFileWithOptions validates that an email file has the required
+// structure and respects the given limits
+func ValidateEmailFileWithOptions(filePath string, opts ValidationOptions) error {
+	if opts.Schema == nil && strings.EqualFold(filepath.Ext(filePath), ".json") {
+		return validateJSONEmailFile(filePath, opts)
+	}
+
+	email, err := LoadEmailFileWithOptions(filePath, opts)
+	if err != nil {
+		return err
+	}
+	return ValidateEmail(email, opts)
+}
+
+// LoadEmailFile reads and parses a JSON or YAML email file
+func LoadEmailFile(filePath string) (map[string]interface{}, error) {
+	return LoadEmailFileWithOptions(filePath, ValidationOptions{})
+}
+
+// LoadEmailFileWithOptions reads and parses an email file like LoadEmailFile,
+// failing files larger than opts.MaxFileBytes without reading them and giving
+// up once opts.ReadTimeout elapses
+func LoadEmailFileWithOptions(filePath string, opts ValidationOptions) (map[string]interface{}, error) {
+	data, err := readEmailFile(filePath, opts.MaxFileBytes, opts.ReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// A .gz file is parsed according to the extension underneath it
+	formatPath := filePath
+	if strings.EqualFold(filepath.Ext(filePath), ".gz") {
+		if data, err = gunzip(data); err != nil {
+			return nil, err
+		}
+		formatPath = strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	}
+
+	var email map[string]interface{}
+	switch strings.ToLower(filepath.Ext(formatPath)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &email); err != nil {
+			if kind := topLevelKind(data, yaml.Unmarshal); kind != "" {
+				return nil, fmt.Errorf("email file must be a YAML mapping, got %s", kind)
+			}
+			return nil, fmt.Errorf("invalid YAML: %v", err)
+		}
+	default:
+		if err := json.Unmarshal(data, &email); err != nil {
+			if kind := topLevelKind(data, json.Unmarshal); kind != "" {
+				return nil, fmt.Errorf("email file must be a JSON object, got %s", kind)
+			}
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	}
+
+	return email, nil
+}
+
+// topLevelKind returns the type of a document that parses but is not an
+// object, such as an array or a scalar, so a failed decode into a map can be
+// reported by what the file holds. It returns "" when the document does not
+// parse or is an object.
+func topLevelKind(data []byte, unmarshal func([]byte, interface{}) error) string {
+	var document interface{}
+	if unmarshal(data, &document) != nil {
+		return ""
+	}
+	switch document.(type) {
+	case nil, map[string]interface{}, map[interface{}]interface{}:
+		return ""
+	}
+	return jsonTypeName(document)
+}
+
+// readEmailFile stats and reads a file, enforcing the size limit and timeout
+// when they are positive
+func readEmailFile(filePath string, maxBytes int64, timeout time.Duration) ([]byte, error) {
+	var data []byte
+	err := withReadTimeout(timeout, func() error {
+		if maxBytes > 0 {
+			if _, err := statEmailFile(filePath, maxBytes); err != nil {
+				return err
+			}
+		}
+		var err error
+		if data, err = ioutil.ReadFile(filePath); err != nil {
+			return fmt.Errorf("failed to read file: %v", err)
+		}
+		return nil
+	})
+	return data, err
+}
+
+// statEmailFile stats a file, failing when it is larger than maxBytes and
+// maxBytes is positive
+func statEmailFile(filePath string, maxBytes int64) (os.FileInfo, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	if maxBytes > 0 && info.Size() > maxBytes {
+		return nil, fmt.Errorf("file is %d bytes, exceeds limit of %d bytes", info.Size(), maxBytes)
+	}
+	return info, nil
+}
+
+// withReadTimeout runs read, giving up once timeout elapses when it is
+// positive. A read that times out is abandoned; its goroutine finishes in the
+// background whenever the filesystem returns, and the caller must not use
+// anything it writes.
+func withReadTimeout(timeout time.Duration, read func() error) error {
+	if timeout <= 0 {
+		return read()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- read()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out reading file after %v", timeout)
+	}
+}
+
+// gunzip decompresses gzip data
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip: %v", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip: %v", err)
+	}
+	return decompressed, nil
+}
+
+// LoadSchema compiles the JSON Schema at schemaPath for use in ValidationOptions
+func LoadSchema(schemaPath string) (*jsonschema.Schema, error) {
+	schema, err := jsonschema.Compile(schemaPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema %s: %v", schemaPath, err)
+	}
+	return schema, nil
+}
+
+// ValidateEmail checks that a parsed email has the required structure and
+// respects the given limits, by running DefaultValidators(opts) followed by
+// opts.Validators. With a schema configured the built-in field checks are
+// replaced by schema validation; the size limit still applies.
+func ValidateEmail(email map[string]interface{}, opts ValidationOptions) error {
+	if err := RunValidators(email, DefaultValidators(opts)...); err != nil {
+		return err
+	}
+	return RunValidators(email, opts.Validators...)
+}
+
+// htmlTagPattern matches an opening or closing tag, a doctype or a comment
+var htmlTagPattern = regexp.MustCompile(`(?i)<(/?[a-z][a-z0-9-]*|!doctype|!--)[^<>]*>`)
+
+// looksLikeHTML reports whether content contains at least one HTML tag
+func looksLikeHTML(content string) bool {
+	return htmlTagPattern.MatchString(content)
+}
+
+// emailDateLayouts are the accepted formats of the optional date field
+var emailDateLayouts = []string{time.RFC1123Z, time.RFC1123, time.RFC3339}
+
+// validateOptionalFields checks the to and date fields when they are present:
+// to must be an address, a comma-separated address list or an array of
+// addresses, and date must be RFC 1123 or RFC 3339
+func validateOptionalFields(email map[string]interface{}) error {
+	if to, exists := email["to"]; exists {
+		switch to := to.(type) {
+		case string:
+			if _, err := mail.ParseAddressList(to); err != nil {
+				return fmt.Errorf("invalid to address %q: %v", to, err)
+			}
+		case []interface{}:
+			if len(to) == 0 {
+				return fmt.Errorf("to must not be an empty list")
+			}
+			for i, item := range to {
+				address, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("to[%d] must be a string, got %s", i, jsonTypeName(item))
+				}
+				if _, err := mail.ParseAddress(address); err != nil {
+					return fmt.Errorf("invalid to[%d] address %q: %v", i, address, err)
+				}
+			}
+		default:
+			return fmt.Errorf("to must be a string or a list of strings, got %s", jsonTypeName(to))
+		}
+	}
+
+	if date, exists := email["date"]; exists {
+		switch date := date.(type) {
+		case time.Time:
+			// YAML decodes unquoted timestamps itself
+		case string:
+			if !parsesAsEmailDate(date) {
+				return fmt.Errorf("invalid date %q: must be RFC 1123 (e.g. %q) or RFC 3339 (e.g. %q)",
+					date, "Mon, 02 Jan 2006 15:04:05 -0700", "2006-01-02T15:04:05Z")
+			}
+		default:
+			return fmt.Errorf("date must be a string, got %s", jsonTypeName(date))
+		}
+	}
+
+	return nil
+}
+
+// validateAttachments checks the attachments field when it is present: it
+// must be an array of objects, each with a non-empty filename and
+// content_type string
+func validateAttachments(email map[string]interface{}) error {
+	attachments, exists := email["attachments"]
+	if !exists {
+		return nil
+	}
+	list, ok := attachments.([]interface{})
+	if !ok {
+		return fmt.Errorf("attachments must be an array, got %s", jsonTypeName(attachments))
+	}
+
+	for i, item := range list {
+		attachment, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("attachments[%d] must be an object, got %s", i, jsonTypeName(item))
+		}
+		for _, field := range []string{"filename", "content_type"} {
+			value, exists := attachment[field]
+			if !exists {
+				return fmt.Errorf("attachments[%d] is missing required field: %s", i, field)
+			}
+			text, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("attachments[%d].%s must be a string, got %s", i, field, jsonTypeName(value))
+			}
+			if strings.TrimSpace(text) == "" {
+				return fmt.Errorf("attachments[%d].%s must not be empty", i, field)
+			}
+		}
+	}
+	return nil
+}
+
+// parsesAsEmailDate reports whether value matches one of emailDateLayouts
+func parsesAsEmailDate(value string) bool {
+	for _, layout := range emailDateLayouts {
+		if _, err := time.Parse(layout, value); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSchema validates an email against a JSON Schema and reports the
+// failing rule and the location of the offending value
+func validateSchema(email map[string]interface{}, schema *jsonschema.Schema) error {
+	err := schema.Validate(email)
+	if err == nil {
+		return nil
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return fmt.Errorf("schema validation failed: %v", err)
+	}
+
+	leaf := validationErr
+	for len(leaf.Causes) > 0 {
+		leaf = leaf.Causes[0]
+	}
+
+	instance := leaf.InstanceLocation
+	if instance == "" {
+		instance = "/"
+	}
+	return fmt.Errorf("schema rule %s failed at %s: %s", leaf.KeywordLocation, instance, leaf.Message)
+}
+
+// jsonTypeName describes the JSON type of a decoded value for error messages
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64, int, int64, uint64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// queueNamePlaceholder matches the {NAME} placeholders ExpandQueueName substitutes
+var queueNamePlaceholder = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandQueueName substitutes each {NAME} placeholder in a queue name with the
+// value of the environment variable NAME, so one setting such as
+// "classify-{ENV}" serves every environment. Placeholders whose variable is
+// unset or empty are reported together as one error.
+func ExpandQueueName(name string) (string, error) {
+	var missing []string
+	expanded := queueNamePlaceholder.ReplaceAllStringFunc(name, func(placeholder string) string {
+		value := os.Getenv(placeholder[1 : len(placeholder)-1])
+		if value == "" {
+			missing = append(missing, placeholder)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unresolved placeholders in queue name %q: %s must be set in the environment", name, strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
@@ -0,0 +1,51 @@
+package emailqueue
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultBaseRef is the git ref --validate-only-changed compares against
+const DefaultBaseRef = "origin/main"
+
+// ChangedEmailFiles returns the email files under dir that were added or
+// modified on the current branch, listed by git diff against the merge base
+// of baseRef and HEAD, so CI on a pull request only handles the emails it
+// touches. Deleted files are left out, and the names are relative to dir and
+// filtered like a scan: the accepted extensions, opts.Prefix and, for a
+// non-recursive scan, only files directly in dir. A baseRef starting with "-"
+// is rejected so it cannot be parsed as a git option.
+func ChangedEmailFiles(dir, baseRef string, opts ScanOptions) ([]string, error) {
+	if baseRef == "" || strings.HasPrefix(baseRef, "-") {
+		return nil, fmt.Errorf("invalid base ref %q: must name a commit, branch or tag", baseRef)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", "-C", dir, "diff", "--name-only", "--diff-filter=d", "--relative", "-z", baseRef+"...HEAD", "--")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// git follows its error with usage hints; the first line is the cause
+		message, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+		return nil, fmt.Errorf("failed to list files changed since %s: %v: %s", baseRef, err, message)
+	}
+
+	var files []string
+	for _, name := range strings.Split(stdout.String(), "\x00") {
+		if name == "" {
+			continue
+		}
+		name = filepath.FromSlash(name)
+		if opts.NonRecursive && strings.ContainsRune(name, filepath.Separator) {
+			continue
+		}
+		base := filepath.Base(name)
+		if isEmailFileExtension(base, opts) && strings.HasPrefix(base, opts.Prefix) {
+			files = append(files, name)
+		}
+	}
+	return files, sortEmailFiles(dir, files, opts.Sort)
+}
@@ -0,0 +1,188 @@
+package emailqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log event
+type Level int
+
+// Log levels, from most to least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the lowercase level name used in structured logs
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// Fields holds the structured attributes of a log event, such as filename,
+// task_id and error
+type Fields map[string]interface{}
+
+// Logger emits log events. The event name is a stable identifier for machine
+// consumers and the message is the human-readable line. Events with an empty
+// name are purely visual (banners, separators) and may be dropped.
+type Logger interface {
+	Log(level Level, event string, fields Fields, message string)
+}
+
+// textLogger writes the human-friendly emoji output through the standard logger
+type textLogger struct{}
+
+// Log prints the message and ignores the structured fields
+func (textLogger) Log(level Level, event string, fields Fields, message string) {
+	log.Print(message)
+}
+
+// jsonLogger writes one JSON object per event for log aggregators
+type jsonLogger struct {
+	mu sync.Mutex
+}
+
+// Log encodes the event with its level, name, message and fields
+func (l *jsonLogger) Log(level Level, event string, fields Fields, message string) {
+	if event == "" {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":    time.Now().UTC().Format(time.RFC3339Nano),
+		"level":   level.String(),
+		"event":   event,
+		"message": strings.TrimSpace(message),
+	}
+	for key, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := json.NewEncoder(os.Stderr).Encode(entry); err != nil {
+		log.Printf("failed to encode log event %s: %v", event, err)
+	}
+}
+
+// loggerMu guards logger and minLevel, which may be changed while other
+// goroutines log, e.g. when main swaps in the progress bar logger
+var loggerMu sync.RWMutex
+
+// logger is the destination for all log events
+var logger Logger = textLogger{}
+
+// minLevel is the least severe level that is logged, set by --log-level
+var minLevel = LevelInfo
+
+// SetLogger sends all log events to l
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+// CurrentLogger returns the destination of log events
+func CurrentLogger() Logger {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return logger
+}
+
+// SetLogLevel sets the least severe level that is logged
+func SetLogLevel(level Level) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	minLevel = level
+}
+
+// LogLevel returns the least severe level that is logged
+func LogLevel() Level {
+	loggerMu.RLock()
+	defer loggerMu.RUnlock()
+	return minLevel
+}
+
+// ParseLevel parses a --log-level value
+func ParseLevel(value string) (Level, error) {
+	switch strings.ToLower(value) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q: expected debug, info, warn or error", value)
+}
+
+// NewLogger returns the logger for the given --log-format value
+func NewLogger(format string) (Logger, error) {
+	switch format {
+	case "", "text":
+		return textLogger{}, nil
+	case "json":
+		return &jsonLogger{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q: expected text or json", format)
+}
+
+// Log logs an event unless its level is below the log level, so programs
+// embedding the manager can add their own events to its output
+func Log(level Level, event string, fields Fields, format string, args ...interface{}) {
+	logAt(level, event, fields, format, args...)
+}
+
+// logAt logs an event unless its level is below minLevel
+func logAt(level Level, event string, fields Fields, format string, args ...interface{}) {
+	loggerMu.RLock()
+	destination, threshold := logger, minLevel
+	loggerMu.RUnlock()
+
+	if level < threshold {
+		return
+	}
+	destination.Log(level, event, fields, fmt.Sprintf(format, args...))
+}
+
+// logDebug logs a diagnostic event, shown only with --log-level=debug
+func logDebug(event string, fields Fields, format string, args ...interface{}) {
+	logAt(LevelDebug, event, fields, format, args...)
+}
+
+// logInfo logs an informational event
+func logInfo(event string, fields Fields, format string, args ...interface{}) {
+	logAt(LevelInfo, event, fields, format, args...)
+}
+
+// logWarn logs a warning event
+func logWarn(event string, fields Fields, format string, args ...interface{}) {
+	logAt(LevelWarn, event, fields, format, args...)
+}
+
+// logError logs an error event
+func logError(event string, fields Fields, format string, args ...interface{}) {
+	logAt(LevelError, event, fields, format, args...)
+}
@@ -0,0 +1,48 @@
+package emailqueue
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics updated by the enqueue loop
+var (
+	emailsQueuedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "email_queue_emails_queued_total",
+		Help: "Number of emails successfully submitted to the Celery queue.",
+	})
+	emailsValidationFailedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "email_queue_validation_failures_total",
+		Help: "Number of email files that failed validation.",
+	})
+	emailsSubmissionFailedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "email_queue_submission_failures_total",
+		Help: "Number of valid emails that could not be submitted to the Celery queue.",
+	})
+	submissionDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "email_queue_submission_duration_seconds",
+		Help:    "Time taken to submit a single email to the Celery queue.",
+		Buckets: prometheus.DefBuckets,
+	})
+	queueDepthGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "email_queue_depth",
+		Help: "Tasks pending in the Celery queues at the last queue depth sample.",
+	})
+)
+
+// StartMetricsServer serves the Prometheus metrics on addr at /metrics
+func StartMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil && err != http.ErrServerClosed {
+			logError("metrics_server_failed", Fields{"error": err}, "❌ Metrics server stopped: %v", err)
+		}
+	}()
+
+	logInfo("metrics_server_started", Fields{"addr": addr}, "📈 Serving metrics at http://%s/metrics", addr)
+}
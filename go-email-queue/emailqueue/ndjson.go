@@ -0,0 +1,169 @@
+package emailqueue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxNDJSONLineBytes bounds a single NDJSON line; it leaves headroom over
+// DefaultMaxContentBytes for the other fields and JSON escaping
+const maxNDJSONLineBytes = 16 * 1024 * 1024
+
+// RunNDJSON validates and queues the emails in a newline-delimited JSON file,
+// one email object per line, submitting each as an inline payload with
+// AddEmailPayloadToQueue. Blank lines are ignored and lines that are not a
+// JSON object are counted in Summary.MalformedLines. Emails are named
+// "<path>:<line>" in logs and in the summary. Of the run options, Validation,
+// Rate, Burst, Dedupe, MaxBacklog, Delay, MaxEmails and ReportSizes apply; emails are
+// submitted in order by a single worker.
+func RunNDJSON(ctx context.Context, manager *EmailQueueManager, path string, opts RunOptions) (Summary, error) {
+	start := time.Now()
+	var summary Summary
+
+	file, err := os.Open(path)
+	if err != nil {
+		return summary, fmt.Errorf("failed to open NDJSON file: %v", err)
+	}
+	defer file.Close()
+
+	limiter := newRateLimiter(opts.Rate, opts.Burst)
+	var seen *contentSet
+	if opts.Dedupe {
+		seen = newContentSet()
+	}
+	summary.TaskIDs = make(map[string]string)
+	sampler := startDepthSampler(ctx, manager, opts.DepthSample)
+	defer sampler.Stop()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxNDJSONLineBytes)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if opts.MaxEmails > 0 && summary.SuccessCount >= opts.MaxEmails {
+			summary.LimitReached = true
+			logInfo("max_emails_reached", Fields{"max_emails": opts.MaxEmails},
+				"🔢 Queued %d emails, the --max-emails limit; skipping the rest", opts.MaxEmails)
+			break
+		}
+
+		name := fmt.Sprintf("%s:%d", path, lineNumber)
+		summary.TotalFiles++
+
+		var email map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &email); err != nil || email == nil {
+			if err == nil {
+				err = errors.New("line is not a JSON object")
+			}
+			logError("malformed_line", Fields{"filename": name, "error": err},
+				"❌ Malformed line %s: %v", name, err)
+			summary.MalformedLines++
+			summary.recordFailure(name, err)
+			continue
+		}
+
+		if limiter != nil && limiter.Wait(ctx) != nil {
+			break
+		}
+		if waitForBacklog(ctx, manager, opts) != nil {
+			break
+		}
+
+		taskID, err := processPayload(ctx, manager, seen, name, email, opts)
+		switch {
+		case errors.Is(err, errDuplicate):
+			summary.Duplicates++
+		case err != nil:
+			summary.recordFailure(name, err)
+		default:
+			summary.SuccessCount++
+			if taskID != "" {
+				summary.TaskIDs[name] = taskID
+			}
+			if opts.ReportSizes {
+				summary.SizeStats.record(int64(len(line)))
+			}
+			pauseAfterSubmit(ctx, manager, opts)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return summary, fmt.Errorf("failed to read NDJSON file: %v", err)
+	}
+	if summary.TotalFiles == 0 && ctx.Err() == nil {
+		return summary, fmt.Errorf("no emails found in %s", path)
+	}
+
+	summary.DepthStats = sampler.Stop()
+	summary.BatchID = manager.BatchID()
+	summary.Duration = time.Since(start)
+
+	summary.QueueDepth = -1
+	if !manager.config.DryRun {
+		if depth, err := manager.QueueDepth(); err != nil {
+			logWarn("queue_depth_failed", Fields{"error": err}, "⚠️  %v", err)
+		} else {
+			summary.QueueDepth = depth
+		}
+	}
+
+	return summary, ctx.Err()
+}
+
+// processPayload validates one inline email and submits it as a payload
+func processPayload(ctx context.Context, manager *EmailQueueManager, seen *contentSet, name string, email map[string]interface{}, opts RunOptions) (string, error) {
+	if opts.NormalizeSubject {
+		NormalizeSubject(email)
+	}
+	if err := ValidateEmail(email, opts.Validation); err != nil {
+		logError("validation_failed", Fields{"filename": name, "error": err},
+			"❌ Validation failed for %s: %v", name, err)
+		emailsValidationFailedTotal.Inc()
+		return "", err
+	}
+	if opts.NormalizeFrom {
+		NormalizeFrom(email)
+	}
+
+	if seen != nil {
+		if original := seen.add(ContentHashField(email, opts.Validation.contentField()), name); original != "" {
+			logInfo("duplicate_skipped", Fields{"filename": name, "duplicate_of": original},
+				"♻️  Skipping %s: same content as %s", name, original)
+			return "", errDuplicate
+		}
+	}
+
+	submitStart := time.Now()
+	taskID, err := submitPayload(ctx, manager, name, email)
+	submissionDurationSeconds.Observe(time.Since(submitStart).Seconds())
+	if err != nil {
+		logError("submit_failed", Fields{"filename": name, "error": err},
+			"❌ Failed to queue %s: %v", name, err)
+		emailsSubmissionFailedTotal.Inc()
+		return "", err
+	}
+
+	emailsQueuedTotal.Inc()
+	return taskID, nil
+}
+
+// submitPayload submits an inline email with AddEmailPayloadToQueue, or with
+// trace headers attached while tracing is enabled
+func submitPayload(ctx context.Context, manager *EmailQueueManager, name string, email map[string]interface{}) (string, error) {
+	return submitTraced(ctx, name, func(headers map[string]interface{}) (string, error) {
+		if headers != nil {
+			return manager.addTask("", payloadDescription(email), email, headers)
+		}
+		return manager.AddEmailPayloadToQueue(email)
+	})
+}
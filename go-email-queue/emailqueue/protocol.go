@@ -0,0 +1,112 @@
+package emailqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gocelery/gocelery"
+)
+
+// Protocol selects the Celery message protocol, matching the workers'
+// task_protocol setting
+type Protocol int
+
+const (
+	// ProtocolV1 carries the task fields in the message body. It is the only
+	// protocol gocelery produces and the default of Celery 3.
+	ProtocolV1 Protocol = 1
+	// ProtocolV2 carries the task fields in message headers and a body of
+	// [args, kwargs, embed]. It is the default of Celery 4 and later.
+	ProtocolV2 Protocol = 2
+)
+
+// ParseProtocol validates a --protocol value
+func ParseProtocol(value string) (Protocol, error) {
+	switch value {
+	case "", "1":
+		return ProtocolV1, nil
+	case "2":
+		return ProtocolV2, nil
+	}
+	return 0, fmt.Errorf("invalid protocol %q: must be %d or %d", value, ProtocolV1, ProtocolV2)
+}
+
+// taskOrigin identifies this producer in the origin header, as Celery does
+var taskOrigin = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return "gen" + strconv.Itoa(os.Getpid()) + "@" + host
+}()
+
+// taskHeadersV2 returns the protocol 2 headers describing task
+func taskHeadersV2(task *gocelery.TaskMessage) map[string]interface{} {
+	var eta, expires interface{}
+	if task.ETA != nil {
+		eta = *task.ETA
+	}
+	if task.Expires != nil {
+		expires = task.Expires.UTC().Format(time.RFC3339Nano)
+	}
+
+	return map[string]interface{}{
+		"lang":       "go",
+		"task":       task.Task,
+		"id":         task.ID,
+		"root_id":    task.ID,
+		"parent_id":  nil,
+		"group":      nil,
+		"shadow":     nil,
+		"eta":        eta,
+		"expires":    expires,
+		"retries":    task.Retries,
+		"timelimit":  []interface{}{nil, nil},
+		"argsrepr":   argumentRepr(task.Args),
+		"kwargsrepr": argumentRepr(task.Kwargs),
+		"origin":     taskOrigin,
+	}
+}
+
+// argumentRepr renders task arguments for the argsrepr and kwargsrepr headers,
+// which Celery only displays
+func argumentRepr(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// taskBodyV2 returns the protocol 2 body of task: its positional and keyword
+// arguments and an empty canvas
+func taskBodyV2(task *gocelery.TaskMessage) []interface{} {
+	return []interface{}{
+		task.Args,
+		task.Kwargs,
+		map[string]interface{}{"callbacks": nil, "errbacks": nil, "chain": nil, "chord": nil},
+	}
+}
+
+// decodeTaskV2 rebuilds a task from the headers and body of a protocol 2 message
+func decodeTaskV2(headers map[string]interface{}, body, contentType string) (*gocelery.TaskMessage, error) {
+	var parts []interface{}
+	if err := decodeBody(body, contentType, &parts); err != nil {
+		return nil, err
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("expected [args, kwargs, embed], got %d elements", len(parts))
+	}
+
+	task := &gocelery.TaskMessage{Kwargs: map[string]interface{}{}}
+	task.ID, _ = headers["id"].(string)
+	task.Task, _ = headers["task"].(string)
+	task.Args, _ = parts[0].([]interface{})
+	if kwargs, ok := parts[1].(map[string]interface{}); ok {
+		task.Kwargs = kwargs
+	}
+	return task, nil
+}
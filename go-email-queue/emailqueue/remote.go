@@ -0,0 +1,191 @@
+package emailqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultFetchTimeout bounds each HTTP request made by RunRemoteIndex
+const DefaultFetchTimeout = 30 * time.Second
+
+// maxRemoteEmailBytes bounds a fetched index or email body; it leaves headroom
+// over DefaultMaxContentBytes for the other fields and JSON escaping
+const maxRemoteEmailBytes = 16 * 1024 * 1024
+
+// IsRemoteURL reports whether location is an http:// or https:// URL rather
+// than a local directory
+func IsRemoteURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// RunRemoteIndex fetches the JSON index at indexURL, an array of email URLs
+// that may be relative to the index, then fetches, validates and queues each
+// email as an inline payload with AddEmailPayloadToQueue. Emails are named by
+// their URL. Timeouts, non-200 responses and invalid JSON count as failed
+// emails. Of the run options, Validation, Rate, Burst, Dedupe, MaxBacklog,
+// Delay, MaxEmails, Progress, FetchTimeout and ReportSizes apply; emails are fetched and
+// submitted in order by a single worker.
+func RunRemoteIndex(ctx context.Context, manager *EmailQueueManager, indexURL string, opts RunOptions) (Summary, error) {
+	start := time.Now()
+	var summary Summary
+
+	timeout := opts.FetchTimeout
+	if timeout <= 0 {
+		timeout = DefaultFetchTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+
+	base, err := url.Parse(indexURL)
+	if err != nil {
+		return summary, fmt.Errorf("invalid index URL: %v", err)
+	}
+	body, err := fetchURL(ctx, client, indexURL)
+	if err != nil {
+		return summary, fmt.Errorf("failed to fetch email index: %v", err)
+	}
+	var emailURLs []string
+	if err := json.Unmarshal(body, &emailURLs); err != nil {
+		return summary, fmt.Errorf("invalid email index %s: expected a JSON array of URLs: %v", indexURL, err)
+	}
+	if len(emailURLs) == 0 {
+		return summary, fmt.Errorf("no emails found in %s", indexURL)
+	}
+	logInfo("emails_found", Fields{"count": len(emailURLs)}, "📁 Found %d emails in %s", len(emailURLs), indexURL)
+
+	limiter := newRateLimiter(opts.Rate, opts.Burst)
+	var seen *contentSet
+	if opts.Dedupe {
+		seen = newContentSet()
+	}
+	summary.TaskIDs = make(map[string]string)
+	sampler := startDepthSampler(ctx, manager, opts.DepthSample)
+
+	for i, ref := range emailURLs {
+		if ctx.Err() != nil {
+			break
+		}
+		if opts.MaxEmails > 0 && summary.SuccessCount >= opts.MaxEmails {
+			summary.LimitReached = true
+			logInfo("max_emails_reached", Fields{"max_emails": opts.MaxEmails},
+				"🔢 Queued %d emails, the --max-emails limit; skipping the rest", opts.MaxEmails)
+			break
+		}
+
+		name := ref
+		if u, err := base.Parse(ref); err == nil {
+			name = u.String()
+		}
+		summary.TotalFiles++
+		logInfo("email_processing", Fields{"filename": name},
+			"\n📧 Processing email %d/%d: %s", i+1, len(emailURLs), name)
+
+		email, size, err := fetchEmail(ctx, client, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logError("fetch_failed", Fields{"filename": name, "error": err},
+				"❌ Failed to fetch %s: %v", name, err)
+			summary.recordFailure(name, err)
+			if opts.Progress != nil {
+				opts.Progress(i+1, len(emailURLs), err)
+			}
+			continue
+		}
+
+		if limiter != nil && limiter.Wait(ctx) != nil {
+			break
+		}
+		if waitForBacklog(ctx, manager, opts) != nil {
+			break
+		}
+
+		taskID, err := processPayload(ctx, manager, seen, name, email, opts)
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(emailURLs), err)
+		}
+		switch {
+		case errors.Is(err, errDuplicate):
+			summary.Duplicates++
+		case err != nil:
+			summary.recordFailure(name, err)
+		default:
+			summary.SuccessCount++
+			if taskID != "" {
+				summary.TaskIDs[name] = taskID
+			}
+			if opts.ReportSizes {
+				summary.SizeStats.record(int64(size))
+			}
+			pauseAfterSubmit(ctx, manager, opts)
+		}
+	}
+
+	summary.DepthStats = sampler.Stop()
+	summary.BatchID = manager.BatchID()
+	summary.Duration = time.Since(start)
+
+	summary.QueueDepth = -1
+	if !manager.config.DryRun {
+		if depth, err := manager.QueueDepth(); err != nil {
+			logWarn("queue_depth_failed", Fields{"error": err}, "⚠️  %v", err)
+		} else {
+			summary.QueueDepth = depth
+		}
+	}
+
+	return summary, ctx.Err()
+}
+
+// fetchEmail downloads and parses one JSON email object and returns the size
+// of its body in bytes
+func fetchEmail(ctx context.Context, client *http.Client, emailURL string) (map[string]interface{}, int, error) {
+	body, err := fetchURL(ctx, client, emailURL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var email map[string]interface{}
+	if err := json.Unmarshal(body, &email); err != nil {
+		return nil, 0, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if email == nil {
+		return nil, 0, errors.New("invalid JSON: body is not a JSON object")
+	}
+	return email, len(body), nil
+}
+
+// fetchURL GETs rawURL and returns its body, failing on any status but 200
+// and on bodies larger than maxRemoteEmailBytes
+func fetchURL(ctx context.Context, client *http.Client, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteEmailBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if len(body) > maxRemoteEmailBytes {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxRemoteEmailBytes)
+	}
+	return body, nil
+}
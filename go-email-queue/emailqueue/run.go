@@ -0,0 +1,1207 @@
+package emailqueue
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RunOptions controls how RunQueueWithOptions finds, validates and queues
+// email files
+type RunOptions struct {
+	Scan                ScanOptions                              // Filters applied when scanning the data directory
+	Validation          ValidationOptions                        // Checks applied to each email file before queuing
+	Glob                string                                   // When set, queue files matching this pattern instead of scanning the directory
+	Files               []string                                 // When non-nil, queue exactly these paths instead of scanning or globbing
+	Concurrency         int                                      // Number of emails validated and submitted in parallel (default: 1)
+	Rate                float64                                  // Maximum emails processed per second across all workers; 0 disables limiting
+	Burst               int                                      // Emails that may be processed in a burst above Rate (default: 1)
+	RatePerQueue        float64                                  // Maximum emails submitted per second to each queue, with a separate token bucket per queue and Burst; 0 disables limiting
+	Dedupe              bool                                     // Skip emails whose content matches an email already seen in this run
+	Idempotent          bool                                     // Skip emails whose filename hash is in the Redis set at IdempotencyKey
+	IdempotencyKey      string                                   // Redis set tracking submitted emails across runs (default: DefaultIdempotencyKey)
+	MaxBacklog          int                                      // Pause while more than this many tasks are pending in the queue; 0 disables backpressure
+	BacklogPoll         time.Duration                            // How often to re-check the queue depth while paused (default: 1s)
+	RetryFailed         int                                      // Extra rounds of submission for emails whose submission failed; 0 disables retries
+	Progress            func(processed, total int, result error) // Called from the workers after each email of the first pass
+	StripGzSuffix       bool                                     // Queue .json.gz files under their name without .gz instead of the original name
+	Delay               time.Duration                            // Pause after each successful submission, per worker; 0 disables the pause
+	SendPayload         bool                                     // Submit the parsed email object instead of its filename, for workers without the data directory
+	MaxEmails           int                                      // Stop once this many emails were queued; 0 means no limit
+	quota               *emailQuota                              // Enforces MaxEmails across workers, set by RunQueueWithOptions
+	queueLimits         *queueLimiters                           // Enforces RatePerQueue, set by RunQueueWithOptions
+	SkipCompleted       bool                                     // Submit under DeterministicTaskID and skip emails whose task already succeeded
+	DeterministicIDs    bool                                     // Submit under DeterministicTaskID instead of a random task ID
+	FetchTimeout        time.Duration                            // Timeout of each HTTP request made by RunRemoteIndex (default: DefaultFetchTimeout)
+	Confirm             func(count int) bool                     // When set, called with the number of files found before queuing; returning false aborts with ErrNotConfirmed
+	ChunkSize           int                                      // Queue emails in chunks of this many, finishing each before the next; 0 queues them as one chunk
+	NormalizeSubject    bool                                     // Trim and collapse whitespace in the subject of submitted payloads before validation; filenames are submitted unchanged
+	NormalizeFrom       bool                                     // Trim the from address of submitted payloads and lowercase its domain after validation, keeping the original in OriginalFromField
+	DepthSample         time.Duration                            // Sample the queue depth at this interval during the run for Summary.DepthStats; 0 disables sampling
+	Checkpoint          string                                   // When set, periodically record in this file how many leading email files were handled
+	Resume              bool                                     // Skip the email files handled according to the Checkpoint file of a previous run
+	ReportSizes         bool                                     // Record the size of each queued email in Summary.SizeStats
+	ValidateConcurrency int                                      // When positive, validate every email file with this many workers before submitting the valid ones; 0 validates each email just before its submission
+	prevalidated        bool                                     // Set by RunQueueWithOptions once validateFiles checked every file
+}
+
+// ErrNotConfirmed is returned by RunQueueWithOptions when RunOptions.Confirm
+// declines the run, before anything is queued
+var ErrNotConfirmed = errors.New("run not confirmed")
+
+// DefaultSubmitDelay is the pause after each submission used by RunQueue
+const DefaultSubmitDelay = 100 * time.Millisecond
+
+// DefaultIdempotencyKey is the Redis set used to track submitted emails
+const DefaultIdempotencyKey = "email_queue:submitted"
+
+// DefaultRunOptions returns the options used by RunQueue
+func DefaultRunOptions() RunOptions {
+	return RunOptions{
+		Scan:        DefaultScanOptions(),
+		Validation:  DefaultValidationOptions(),
+		Concurrency: 1,
+		Delay:       DefaultSubmitDelay,
+	}
+}
+
+// Summary reports the outcome of a queue run
+type Summary struct {
+	TotalFiles       int               // Number of email files found
+	SuccessCount     int               // Emails submitted to the queue
+	ErrorCount       int               // Emails that failed validation or submission
+	FailedFiles      []string          // Names of the emails counted in ErrorCount
+	Failures         []FailedEmail     // The emails counted in ErrorCount with the error that failed each
+	ValidationErrors map[string]int    // Failures other than submission errors, counted by normalized message
+	Duplicates       int               // Emails skipped because their content was already queued in this run
+	AlreadySubmitted int               // Emails skipped because a previous run already submitted them
+	AlreadyCompleted int               // Emails skipped because the result backend holds a successful result for them
+	Recovered        int               // Emails queued by a retry round after their first submission failed
+	LimitReached     bool              // The run stopped early because MaxEmails emails were queued
+	MalformedLines   int               // NDJSON lines that were not a JSON object, also counted in ErrorCount
+	Stale            int               // Email files skipped because they were modified before Scan.Since; not counted in TotalFiles
+	Resumed          int               // Email files skipped because the checkpoint of a previous run covers them; not counted in TotalFiles
+	TaskIDs          map[string]string // Task ID of each queued email, keyed by filename; empty in dry-run mode
+	BatchID          string            // Batch ID sent with every task of the run, see Config.BatchID
+	Duration         time.Duration     // Wall-clock time of the run
+	QueueDepth       int               // Tasks pending in the queue when the run finished; -1 if unknown
+	DepthStats       DepthStats        // Queue depth sampled during the run when RunOptions.DepthSample is set
+	SizeStats        SizeStats         // Sizes of the queued emails when RunOptions.ReportSizes is set
+}
+
+// FailedEmail records an email that was not queued and why
+type FailedEmail struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// SizeStats summarizes the sizes of the emails queued during a run: the file
+// size for email files, the line length for NDJSON and the response body
+// length for remote emails
+type SizeStats struct {
+	Count int     // Number of emails measured; the other fields are zero without emails
+	Total int64   // Sum of the sizes in bytes
+	Max   int64   // Largest size in bytes
+	Avg   float64 // Mean size in bytes
+}
+
+// record adds the size of one queued email to the stats
+func (s *SizeStats) record(size int64) {
+	s.Count++
+	s.Total += size
+	if size > s.Max {
+		s.Max = size
+	}
+	s.Avg = float64(s.Total) / float64(s.Count)
+}
+
+// SuccessRate returns the percentage of found files that were queued
+func (s Summary) SuccessRate() float64 {
+	if s.TotalFiles == 0 {
+		return 0
+	}
+	return float64(s.SuccessCount) / float64(s.TotalFiles) * 100
+}
+
+// RunQueue validates and queues every email file in dir using the default options
+func RunQueue(manager *EmailQueueManager, dir string) (Summary, error) {
+	return RunQueueWithOptions(context.Background(), manager, dir, DefaultRunOptions())
+}
+
+// RunQueueWithOptions validates and queues each email file in dir, using up to
+// opts.Concurrency workers. When ctx is cancelled no further emails are
+// started; emails already in progress finish and the partial summary is
+// returned together with ctx.Err().
+func RunQueueWithOptions(ctx context.Context, manager *EmailQueueManager, dir string, opts RunOptions) (Summary, error) {
+	start := time.Now()
+	var summary Summary
+
+	emailFiles, stale, err := findEmailFiles(dir, opts)
+	if err != nil {
+		return summary, fmt.Errorf("failed to get email files: %v", err)
+	}
+	summary.Stale = stale
+	if stale > 0 {
+		logInfo("stale_skipped", Fields{"count": stale, "since": opts.Scan.Since},
+			"🕰️  Skipped %d email files modified before %s", stale, opts.Scan.Since.Format(time.RFC3339))
+	}
+	if len(emailFiles) == 0 {
+		if stale > 0 {
+			return summary, fmt.Errorf("no email files modified since %s found in %s", opts.Scan.Since.Format(time.RFC3339), dir)
+		}
+		return summary, fmt.Errorf("no email files found in %s", dir)
+	}
+
+	logInfo("scan_completed", Fields{"count": len(emailFiles)}, "📧 Found %d email files", len(emailFiles))
+	warnBaseNameCollisions(emailFiles)
+	if opts.Resume && opts.Checkpoint != "" {
+		emailFiles, summary.Resumed, err = resumeFromCheckpoint(opts.Checkpoint, dir, emailFiles)
+		if err != nil {
+			return summary, err
+		}
+		if summary.Resumed > 0 {
+			logInfo("resumed", Fields{"path": opts.Checkpoint, "skipped": summary.Resumed},
+				"⏩ Resuming from %s: skipping %d email files handled by a previous run", opts.Checkpoint, summary.Resumed)
+		}
+		if len(emailFiles) == 0 {
+			return summary, fmt.Errorf("no email files left to queue after checkpoint %s", opts.Checkpoint)
+		}
+	}
+	summary.TotalFiles = len(emailFiles)
+	if opts.Confirm != nil && !opts.Confirm(len(emailFiles)) {
+		return summary, ErrNotConfirmed
+	}
+	sampler := startDepthSampler(ctx, manager, opts.DepthSample)
+	checkpoint := newCheckpointer(opts.Checkpoint, dir, emailFiles, summary.Resumed)
+
+	if opts.Idempotent && opts.IdempotencyKey == "" {
+		opts.IdempotencyKey = DefaultIdempotencyKey
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	limiter := newRateLimiter(opts.Rate, opts.Burst)
+	opts.queueLimits = newQueueLimiters(opts.RatePerQueue, opts.Burst)
+	opts.quota = newEmailQuota(opts.MaxEmails)
+
+	var seen *contentSet
+	if opts.Dedupe {
+		seen = newContentSet()
+	}
+
+	// Validate every file up front so file reads and parsing overlap
+	// instead of waiting on submissions
+	var validated []map[string]interface{}
+	var validationErrs []error
+	if opts.ValidateConcurrency > 0 {
+		validated, validationErrs = validateFiles(ctx, dir, emailFiles, opts)
+		opts.prevalidated = ctx.Err() == nil
+	}
+
+	// Results are stored by index so the summary keeps the input order
+	results := make([]error, len(emailFiles))
+	taskIDs := make([]string, len(emailFiles))
+	processed := make([]bool, len(emailFiles))
+
+	var processedCount atomic.Int64
+	finish := func(i int) {
+		processed[i] = true
+		if results[i] == nil || IsSkipped(results[i]) {
+			checkpoint.markDone(i)
+		}
+		if opts.Progress != nil {
+			opts.Progress(int(processedCount.Add(1)), len(emailFiles), results[i])
+		}
+	}
+	handle := func(i int) {
+		// Emails handed out just before cancellation or after the limit was
+		// reached stay unprocessed
+		if ctx.Err() != nil || opts.quota.full() {
+			return
+		}
+		// Files that failed the validation phase need no token or submission
+		if validationErrs != nil && validationErrs[i] != nil {
+			results[i] = validationErrs[i]
+			finish(i)
+			return
+		}
+		// Wait for a token; a cancelled wait leaves the email unprocessed
+		if limiter != nil && limiter.Wait(ctx) != nil {
+			return
+		}
+		if waitForBacklog(ctx, manager, opts) != nil {
+			return
+		}
+
+		logInfo("email_processing", Fields{"filename": emailFiles[i]},
+			"\n📧 Processing email %d/%d: %s", i+1, len(emailFiles), emailFiles[i])
+		var email map[string]interface{}
+		if validated != nil {
+			// Dropped once handed over so the run does not keep every email
+			email, validated[i] = validated[i], nil
+		}
+		taskIDs[i], results[i] = processEmail(ctx, manager, seen, dir, emailFiles[i], email, opts)
+		if errors.Is(results[i], errLimitReached) || errors.Is(results[i], errInterrupted) {
+			return
+		}
+		finish(i)
+		if results[i] == nil {
+			pauseAfterSubmit(ctx, manager, opts)
+		}
+	}
+
+	jobs := make(chan int)
+	var wg, pending sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				handle(i)
+				pending.Done()
+			}
+		}()
+	}
+
+	// Each chunk finishes before the next one starts
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 || chunkSize > len(emailFiles) {
+		chunkSize = len(emailFiles)
+	}
+	chunks := (len(emailFiles) + chunkSize - 1) / chunkSize
+	for chunk := 0; chunk < chunks; chunk++ {
+		first := chunk * chunkSize
+		last := first + chunkSize
+		if last > len(emailFiles) {
+			last = len(emailFiles)
+		}
+		for i := first; i < last; i++ {
+			if ctx.Err() != nil || opts.quota.full() {
+				break
+			}
+			pending.Add(1)
+			jobs <- i
+		}
+		pending.Wait()
+		if chunks > 1 {
+			logChunkSummary(chunk+1, chunks, first, last, results[first:last], processed[first:last])
+		}
+		if ctx.Err() != nil || opts.quota.full() {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if opts.quota.full() && countFalse(processed) > 0 {
+		summary.LimitReached = true
+		logInfo("max_emails_reached", Fields{"max_emails": opts.MaxEmails},
+			"🔢 Queued %d emails, the --max-emails limit; skipping the rest", opts.MaxEmails)
+	}
+
+	summary.Recovered = retryFailedSubmissions(ctx, manager, limiter, dir, emailFiles, taskIDs, results, opts)
+	for i := range emailFiles {
+		if processed[i] && results[i] == nil {
+			checkpoint.markDone(i)
+		}
+	}
+	checkpoint.finish()
+
+	summary.TaskIDs = make(map[string]string)
+	for i, emailFile := range emailFiles {
+		if !processed[i] {
+			continue
+		}
+		if errors.Is(results[i], errDuplicate) {
+			summary.Duplicates++
+			continue
+		}
+		if errors.Is(results[i], errAlreadySubmitted) {
+			summary.AlreadySubmitted++
+			continue
+		}
+		if errors.Is(results[i], errAlreadyCompleted) {
+			summary.AlreadyCompleted++
+			continue
+		}
+		if results[i] != nil {
+			summary.recordFailure(emailFile, results[i])
+			continue
+		}
+		summary.SuccessCount++
+		if taskIDs[i] != "" {
+			summary.TaskIDs[emailFile] = taskIDs[i]
+		}
+		if opts.ReportSizes {
+			if info, err := os.Stat(filepath.Join(dir, emailFile)); err == nil {
+				summary.SizeStats.record(info.Size())
+			}
+		}
+	}
+
+	summary.DepthStats = sampler.Stop()
+	summary.BatchID = manager.BatchID()
+	summary.Duration = time.Since(start)
+
+	summary.QueueDepth = -1
+	if !manager.config.DryRun {
+		if depth, err := manager.QueueDepth(); err != nil {
+			logWarn("queue_depth_failed", Fields{"error": err}, "⚠️  %v", err)
+		} else {
+			summary.QueueDepth = depth
+		}
+	}
+
+	return summary, ctx.Err()
+}
+
+// logChunkSummary logs the outcome of the emails first to last (exclusive)
+// once their chunk is done
+func logChunkSummary(chunk, chunks, first, last int, results []error, processed []bool) {
+	queued, failed, skipped := 0, 0, 0
+	for i, err := range results {
+		switch {
+		case !processed[i]:
+		case err == nil:
+			queued++
+		case IsSkipped(err):
+			skipped++
+		default:
+			failed++
+		}
+	}
+	logInfo("chunk_completed", Fields{"chunk": chunk, "chunks": chunks, "queued": queued, "failed": failed, "skipped": skipped},
+		"\n📦 Chunk %d/%d (emails %d-%d): %d queued, %d failed, %d skipped", chunk, chunks, first+1, last, queued, failed, skipped)
+}
+
+// retryFailedSubmissions re-submits the emails whose submission failed, for up
+// to opts.RetryFailed rounds, pausing between rounds with exponential backoff.
+// Validation failures are not retried. taskIDs and results are updated in
+// place and the number of emails recovered is returned.
+func retryFailedSubmissions(ctx context.Context, manager *EmailQueueManager, limiter *rate.Limiter, dir string, emailFiles, taskIDs []string, results []error, opts RunOptions) int {
+	recovered := 0
+	backoff := initialRetryBackoff
+	busyBackoff := initialBusyBackoff
+
+	for round := 1; round <= opts.RetryFailed; round++ {
+		var failed []int
+		condition := ""
+		for i, err := range results {
+			var submitErr *submissionError
+			if errors.As(err, &submitErr) {
+				failed = append(failed, i)
+				if busy := redisBusyCondition(err); busy != "" {
+					condition = busy
+				}
+			}
+		}
+		if len(failed) == 0 || ctx.Err() != nil {
+			break
+		}
+
+		// Redis out of memory or loading needs longer to recover than a
+		// dropped connection
+		wait := backoff
+		if condition != "" {
+			wait = busyBackoff
+			busyBackoff = nextBackoff(busyBackoff, maxBusyBackoff)
+			logWarn("redis_busy", Fields{"round": round, "condition": condition},
+				"🐢 Redis reports %s, backing off %v before retrying", condition, wait)
+		}
+		backoff = nextBackoff(backoff, maxRetryBackoff)
+
+		logInfo("retry_round", Fields{"round": round, "count": len(failed)},
+			"\n🔁 Retry round %d/%d: %d failed emails in %v", round, opts.RetryFailed, len(failed), wait)
+		select {
+		case <-ctx.Done():
+			return recovered
+		case <-time.After(wait):
+		}
+
+		for _, i := range failed {
+			if ctx.Err() != nil {
+				return recovered
+			}
+			if limiter != nil && limiter.Wait(ctx) != nil {
+				return recovered
+			}
+			// Payloads are not kept after the first pass, so reload them
+			var email map[string]interface{}
+			if opts.SendPayload {
+				if email, results[i] = checkEmailFile(filepath.Join(dir, emailFiles[i]), true, opts); results[i] != nil {
+					continue
+				}
+			}
+			// A retry that was never attempted keeps the earlier failure
+			taskID, err := submitEmail(ctx, manager, emailFiles[i], email, opts)
+			if errors.Is(err, errInterrupted) {
+				return recovered
+			}
+			if errors.Is(err, errLimitReached) {
+				continue
+			}
+			taskIDs[i], results[i] = taskID, err
+			if err == nil {
+				recovered++
+			}
+		}
+	}
+
+	return recovered
+}
+
+// pauseAfterSubmit sleeps for opts.Delay after a submission so a worker does
+// not overwhelm the queue. Nothing is submitted in dry-run mode, so it
+// returns immediately there, and early when ctx is cancelled.
+func pauseAfterSubmit(ctx context.Context, manager *EmailQueueManager, opts RunOptions) {
+	if opts.Delay <= 0 || manager.config.DryRun {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(opts.Delay):
+	}
+}
+
+// countFalse returns how many entries of flags are false
+func countFalse(flags []bool) int {
+	n := 0
+	for _, flag := range flags {
+		if !flag {
+			n++
+		}
+	}
+	return n
+}
+
+// emailQuota caps the number of successful submissions across workers.
+// Slots are claimed before submitting so concurrent workers cannot overshoot
+// the limit. A nil quota is unlimited.
+type emailQuota struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+}
+
+// newEmailQuota returns a quota of limit submissions, or nil when limit is not positive
+func newEmailQuota(limit int) *emailQuota {
+	if limit <= 0 {
+		return nil
+	}
+	return &emailQuota{limit: limit}
+}
+
+// acquire claims a slot, reporting false when the limit is reached
+func (q *emailQuota) acquire() bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.used >= q.limit {
+		return false
+	}
+	q.used++
+	return true
+}
+
+// release returns a slot claimed for a submission that failed
+func (q *emailQuota) release() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used--
+}
+
+// full reports whether every slot is claimed
+func (q *emailQuota) full() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used >= q.limit
+}
+
+// newRateLimiter returns a token bucket allowing ratePerSecond emails with
+// the given burst, or nil when rate limiting is disabled
+func newRateLimiter(ratePerSecond float64, burst int) *rate.Limiter {
+	if ratePerSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(ratePerSecond), burst)
+}
+
+// queueLimiters holds a token bucket per queue, so a queue that reached its
+// rate does not hold back submissions to the others
+type queueLimiters struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    int
+	limiters map[string]*rate.Limiter
+}
+
+// newQueueLimiters returns per-queue token buckets allowing ratePerSecond
+// emails with the given burst, or nil when per-queue limiting is disabled
+func newQueueLimiters(ratePerSecond float64, burst int) *queueLimiters {
+	if ratePerSecond <= 0 {
+		return nil
+	}
+	return &queueLimiters{rate: ratePerSecond, burst: burst, limiters: make(map[string]*rate.Limiter)}
+}
+
+// wait blocks until the bucket of queueName has a token or ctx is done. A
+// nil queueLimiters never blocks.
+func (q *queueLimiters) wait(ctx context.Context, queueName string) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	limiter, ok := q.limiters[queueName]
+	if !ok {
+		limiter = newRateLimiter(q.rate, q.burst)
+		q.limiters[queueName] = limiter
+	}
+	q.mu.Unlock()
+	return limiter.Wait(ctx)
+}
+
+// Sentinel results for emails that are skipped rather than failed
+var (
+	errDuplicate        = errors.New("duplicate email content")
+	errAlreadySubmitted = errors.New("email already submitted")
+	errAlreadyCompleted = errors.New("email already processed")
+	errLimitReached     = errors.New("max emails reached")
+	errInterrupted      = errors.New("run interrupted before submission")
+)
+
+// IsSkipped reports whether the per-email result passed to
+// RunOptions.Progress means the email was skipped, as a duplicate or as
+// already submitted or completed, rather than queued or failed
+func IsSkipped(result error) bool {
+	return errors.Is(result, errDuplicate) || errors.Is(result, errAlreadySubmitted) || errors.Is(result, errAlreadyCompleted)
+}
+
+// submissionError marks a failure to reach the queue, as opposed to a
+// validation failure, so the email is eligible for a retry round
+type submissionError struct {
+	err error
+}
+
+func (e *submissionError) Error() string { return e.err.Error() }
+func (e *submissionError) Unwrap() error { return e.err }
+
+// contentSet records the content hashes seen during a run
+type contentSet struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// newContentSet creates an empty content set
+func newContentSet() *contentSet {
+	return &contentSet{hashes: make(map[string]string)}
+}
+
+// add records the hash for emailFile and returns the file that first added
+// it, or an empty string if the hash is new
+func (cs *contentSet) add(hash, emailFile string) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if original, exists := cs.hashes[hash]; exists {
+		return original
+	}
+	cs.hashes[hash] = emailFile
+	return ""
+}
+
+// ContentHash returns the SHA-256 of an email's from, subject and html_content,
+// so copies of the same email under different filenames hash identically
+func ContentHash(email map[string]interface{}) string {
+	return ContentHashField(email, DefaultContentField)
+}
+
+// ContentHashField is ContentHash for emails whose body is in contentField
+func ContentHashField(email map[string]interface{}, contentField string) string {
+	normalized, _ := json.Marshal([]interface{}{email["from"], email["subject"], email[contentField]})
+	sum := sha256.Sum256(normalized)
+	return hex.EncodeToString(sum[:])
+}
+
+// waitForBacklog blocks while the queue holds more than opts.MaxBacklog pending
+// tasks, re-checking every opts.BacklogPoll. A depth lookup failure is logged
+// and does not block the run.
+func waitForBacklog(ctx context.Context, manager *EmailQueueManager, opts RunOptions) error {
+	if opts.MaxBacklog <= 0 || manager.config.DryRun {
+		return nil
+	}
+
+	poll := opts.BacklogPoll
+	if poll <= 0 {
+		poll = time.Second
+	}
+
+	paused := false
+	for {
+		depth, err := manager.QueueDepth()
+		if err != nil {
+			logWarn("queue_depth_failed", Fields{"error": err}, "⚠️  %v", err)
+			return nil
+		}
+		if depth <= opts.MaxBacklog {
+			if paused {
+				logInfo("backpressure_released", Fields{"queue_depth": depth},
+					"▶️  Queue depth %d is back under %d, resuming", depth, opts.MaxBacklog)
+			}
+			return nil
+		}
+
+		if !paused {
+			logWarn("backpressure", Fields{"queue_depth": depth, "max_backlog": opts.MaxBacklog},
+				"⏸️  Queue depth %d exceeds %d, pausing until workers catch up", depth, opts.MaxBacklog)
+			paused = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+// processEmail validates a single email file and submits it to the queue.
+// When seen is set, emails whose content hash was already seen return
+// errDuplicate without being submitted. email is the email already loaded by
+// the validation phase, or nil. The task ID is returned on success.
+func processEmail(ctx context.Context, manager *EmailQueueManager, seen *contentSet, dir, emailFile string, email map[string]interface{}, opts RunOptions) (string, error) {
+	// Validate email file. Only dedupe and payload submission need the whole
+	// email, so otherwise large files are stream-checked instead of loaded,
+	// unless the validation phase already checked or loaded them.
+	load := seen != nil || opts.SendPayload
+	if email == nil && (load || !opts.prevalidated) {
+		var err error
+		if email, err = checkEmailFile(filepath.Join(dir, emailFile), load, opts); err != nil {
+			logValidationFailure(emailFile, err)
+			return "", err
+		}
+	}
+
+	// Skip content already queued under another filename
+	if seen != nil {
+		if original := seen.add(ContentHashField(email, opts.Validation.contentField()), emailFile); original != "" {
+			logInfo("duplicate_skipped", Fields{"filename": emailFile, "duplicate_of": original},
+				"♻️  Skipping %s: same content as %s", emailFile, original)
+			return "", errDuplicate
+		}
+	}
+
+	return submitEmail(ctx, manager, emailFile, email, opts)
+}
+
+// checkEmailFile validates the email file at filePath, loading and returning
+// the email when load is set and stream-checking it otherwise
+func checkEmailFile(filePath string, load bool, opts RunOptions) (map[string]interface{}, error) {
+	if !load {
+		return nil, ValidateEmailFileWithOptions(filePath, opts.Validation)
+	}
+	email, err := LoadEmailFileWithOptions(filePath, opts.Validation)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SendPayload {
+		return email, validatePayload(email, opts)
+	}
+	return email, ValidateEmail(email, opts.Validation)
+}
+
+// validatePayload validates an email submitted as the task payload, applying
+// the NormalizeSubject and NormalizeFrom options around the checks
+func validatePayload(email map[string]interface{}, opts RunOptions) error {
+	if opts.NormalizeSubject {
+		NormalizeSubject(email)
+	}
+	if err := ValidateEmail(email, opts.Validation); err != nil {
+		return err
+	}
+	if opts.NormalizeFrom {
+		NormalizeFrom(email)
+	}
+	return nil
+}
+
+// logValidationFailure logs and counts an email file that failed validation
+func logValidationFailure(emailFile string, err error) {
+	logError("validation_failed", Fields{"filename": emailFile, "error": err},
+		"❌ Validation failed for %s: %v", emailFile, err)
+	emailsValidationFailedTotal.Inc()
+}
+
+// validateFiles validates every email file with up to opts.ValidateConcurrency
+// workers and returns the validation error of each, in order. Files left
+// unchecked because ctx was cancelled have no error. With Dedupe or
+// SendPayload the loaded emails are returned too, so they are not read again
+// before submission.
+func validateFiles(ctx context.Context, dir string, emailFiles []string, opts RunOptions) ([]map[string]interface{}, []error) {
+	start := time.Now()
+	errs := make([]error, len(emailFiles))
+	load := opts.Dedupe || opts.SendPayload
+	var emails []map[string]interface{}
+	if load {
+		emails = make([]map[string]interface{}, len(emailFiles))
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.ValidateConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				email, err := checkEmailFile(filepath.Join(dir, emailFiles[i]), load, opts)
+				if err != nil {
+					logValidationFailure(emailFiles[i], err)
+					errs[i] = err
+				} else if load {
+					emails[i] = email
+				}
+			}
+		}()
+	}
+	for i := range emailFiles {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	invalid := 0
+	for _, err := range errs {
+		if err != nil {
+			invalid++
+		}
+	}
+	logInfo("validation_completed", Fields{"count": len(emailFiles), "invalid": invalid, "workers": opts.ValidateConcurrency, "duration": time.Since(start).String()},
+		"🔍 Validated %d email files with %d workers in %v: %d invalid", len(emailFiles), opts.ValidateConcurrency, time.Since(start).Round(time.Millisecond), invalid)
+	return emails, errs
+}
+
+// submitEmail submits a validated email to the queue, skipping it when a
+// previous run already submitted it, and returns its task ID. With
+// opts.SendPayload the parsed email is submitted instead of the filename.
+// Failures are returned as *submissionError.
+func submitEmail(ctx context.Context, manager *EmailQueueManager, emailFile string, email map[string]interface{}, opts RunOptions) (string, error) {
+	// Skip emails a previous run already submitted
+	filenameHash := FilenameHash(emailFile)
+	if opts.Idempotent {
+		submitted, err := manager.IsSubmitted(opts.IdempotencyKey, filenameHash)
+		if err != nil {
+			logError("submit_failed", Fields{"filename": emailFile, "error": err},
+				"❌ Failed to queue %s: %v", emailFile, err)
+			emailsSubmissionFailedTotal.Inc()
+			return "", &submissionError{err}
+		}
+		if submitted {
+			logInfo("already_submitted", Fields{"filename": emailFile},
+				"⏭️  Skipping %s: already submitted by a previous run", emailFile)
+			return "", errAlreadySubmitted
+		}
+	}
+
+	// Skip emails whose task already succeeded in a previous run
+	if opts.SkipCompleted {
+		completed, err := manager.IsCompleted(DeterministicTaskID(emailFile))
+		if err != nil {
+			logError("submit_failed", Fields{"filename": emailFile, "error": err},
+				"❌ Failed to queue %s: %v", emailFile, err)
+			emailsSubmissionFailedTotal.Inc()
+			return "", &submissionError{err}
+		}
+		if completed {
+			logInfo("already_completed", Fields{"filename": emailFile},
+				"🏁 Skipping %s: its task already completed successfully", emailFile)
+			return "", errAlreadyCompleted
+		}
+	}
+
+	queuedName := emailFile
+	if opts.StripGzSuffix && strings.EqualFold(filepath.Ext(emailFile), ".gz") {
+		queuedName = strings.TrimSuffix(emailFile, filepath.Ext(emailFile))
+	}
+
+	// Pick the queue up front so the email waits for a token of the queue it
+	// is submitted to
+	var queueName string
+	if opts.queueLimits != nil {
+		queueName = manager.routeQueue(queuedName)
+		if opts.queueLimits.wait(ctx, queueName) != nil {
+			return "", errInterrupted
+		}
+	}
+
+	// Claim one of the MaxEmails slots; a failed submission gives it back
+	if !opts.quota.acquire() {
+		return "", errLimitReached
+	}
+
+	// Add to queue
+	submitStart := time.Now()
+	taskID, err := submitTraced(ctx, emailFile, func(headers map[string]interface{}) (string, error) {
+		// Fixed task IDs, trace headers and a queue picked for the per-queue
+		// rate limit need a hand-built message
+		if opts.SkipCompleted || opts.DeterministicIDs || headers != nil || queueName != "" {
+			var arg interface{} = queuedName
+			if opts.SendPayload {
+				arg = email
+			}
+			var taskID string
+			if opts.SkipCompleted || opts.DeterministicIDs {
+				taskID = DeterministicTaskID(emailFile)
+			}
+			if queueName != "" {
+				return manager.addTaskTo(queueName, taskID, queuedName, arg, headers)
+			}
+			return manager.addTask(taskID, queuedName, arg, headers)
+		}
+		if opts.SendPayload {
+			return manager.AddEmailPayloadToQueue(email)
+		}
+		if len(manager.config.Queues) > 0 {
+			_, taskID, err := manager.AddEmailToQueueRouted(queuedName)
+			return taskID, err
+		}
+		return manager.AddEmailToQueue(queuedName)
+	})
+	submissionDurationSeconds.Observe(time.Since(submitStart).Seconds())
+	logDebug("submit_timing", Fields{"filename": emailFile, "duration": time.Since(submitStart).String()},
+		"⏱️  Submission of %s took %v", emailFile, time.Since(submitStart).Round(time.Microsecond))
+	if err != nil {
+		opts.quota.release()
+		logError("submit_failed", Fields{"filename": emailFile, "error": err},
+			"❌ Failed to queue %s: %v", emailFile, err)
+		emailsSubmissionFailedTotal.Inc()
+		return "", &submissionError{err}
+	}
+
+	// Record the submission so later runs skip it
+	if opts.Idempotent && !manager.config.DryRun {
+		if err := manager.MarkSubmitted(opts.IdempotencyKey, filenameHash); err != nil {
+			logWarn("idempotency_update_failed", Fields{"filename": emailFile, "error": err},
+				"⚠️  Queued %s but failed to record it: %v", emailFile, err)
+		}
+	}
+
+	emailsQueuedTotal.Inc()
+	return taskID, nil
+}
+
+// recordFailure counts a failed email and remembers its name and error
+func (s *Summary) recordFailure(emailFile string, err error) {
+	s.ErrorCount++
+	s.FailedFiles = append(s.FailedFiles, emailFile)
+	s.Failures = append(s.Failures, FailedEmail{Filename: emailFile, Error: err.Error()})
+
+	var submitErr *submissionError
+	if !errors.As(err, &submitErr) {
+		if s.ValidationErrors == nil {
+			s.ValidationErrors = make(map[string]int)
+		}
+		s.ValidationErrors[normalizeValidationError(err.Error())]++
+	}
+}
+
+var (
+	quotedValuePattern = regexp.MustCompile(` ?"[^"]*"`)
+	numberPattern      = regexp.MustCompile(`[0-9]+`)
+)
+
+// normalizeValidationError reduces a validation error to its kind so errors
+// from different files group together: details after the first colon are
+// dropped (but a missing field's name is kept), quoted values are removed
+// and numbers become N. "invalid JSON: unexpected end of JSON input" becomes
+// "invalid JSON" and "attachments[2] is missing required field: filename"
+// becomes "attachments[N] is missing required field: filename".
+func normalizeValidationError(message string) string {
+	parts := strings.SplitN(message, ": ", 3)
+	message = parts[0]
+	if len(parts) > 1 && strings.HasSuffix(parts[0], "field") {
+		message += ": " + parts[1]
+	}
+	message = quotedValuePattern.ReplaceAllString(message, "")
+	return numberPattern.ReplaceAllString(message, "N")
+}
+
+// SortedValidationErrors returns the normalized validation errors, most
+// frequent first and alphabetically among equal counts
+func (s Summary) SortedValidationErrors() []string {
+	messages := make([]string, 0, len(s.ValidationErrors))
+	for message := range s.ValidationErrors {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if s.ValidationErrors[messages[i]] != s.ValidationErrors[messages[j]] {
+			return s.ValidationErrors[messages[i]] > s.ValidationErrors[messages[j]]
+		}
+		return messages[i] < messages[j]
+	})
+	return messages
+}
+
+// findEmailFiles lists the email files to queue, relative to dir, and how
+// many scanned or globbed files were skipped as modified before
+// opts.Scan.Since. Explicit Files lists are taken as given.
+func findEmailFiles(dir string, opts RunOptions) ([]string, int, error) {
+	if opts.Files != nil {
+		files, err := relativeToDir(opts.Files, dir)
+		return files, 0, err
+	}
+	if opts.Glob == "" {
+		return scanEmailFiles(dir, opts.Scan)
+	}
+
+	matches, err := GetEmailFilesByGlob(opts.Glob)
+	if err != nil {
+		return nil, 0, err
+	}
+	files, err := relativeToDir(matches, dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	files, stale, err := skipStaleFiles(dir, files, opts.Scan.Since)
+	if err != nil {
+		return nil, 0, err
+	}
+	return files, stale, sortEmailFiles(dir, files, opts.Scan.Sort)
+}
+
+// warnBaseNameCollisions warns about email files in different subdirectories
+// that share a base name. They are queued under their distinct relative paths,
+// but a worker that reads emails by base name would mix them up.
+func warnBaseNameCollisions(files []string) {
+	paths := make(map[string][]string)
+	var names []string
+	for _, file := range files {
+		name := filepath.Base(file)
+		if len(paths[name]) == 1 {
+			names = append(names, name)
+		}
+		paths[name] = append(paths[name], file)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		logWarn("filename_collision", Fields{"filename": name, "paths": paths[name]},
+			"⚠️  %d email files are named %s (%s); they are queued under their relative paths, so workers must not look them up by base name",
+			len(paths[name]), name, strings.Join(paths[name], ", "))
+	}
+}
+
+// skipStaleFiles drops the files, given relative to dir, last modified before
+// since and returns the rest with the number dropped
+func skipStaleFiles(dir string, files []string, since time.Time) ([]string, int, error) {
+	if since.IsZero() {
+		return files, 0, nil
+	}
+
+	fresh := files[:0]
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(dir, file))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to stat %s: %v", file, err)
+		}
+		if !info.ModTime().Before(since) {
+			fresh = append(fresh, file)
+		}
+	}
+	return fresh, len(files) - len(fresh), nil
+}
+
+// FindInvalidEmails validates every email file RunQueueWithOptions would
+// pick up, without submitting anything, and returns how many files were
+// checked and the ones that failed with their errors. Of the run options,
+// Files, Glob, Scan and Validation apply.
+func FindInvalidEmails(dir string, opts RunOptions) (int, []FailedEmail, error) {
+	emailFiles, _, err := findEmailFiles(dir, opts)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get email files: %v", err)
+	}
+
+	var invalid []FailedEmail
+	for _, emailFile := range emailFiles {
+		if err := ValidateEmailFileWithOptions(filepath.Join(dir, emailFile), opts.Validation); err != nil {
+			invalid = append(invalid, FailedEmail{Filename: emailFile, Error: err.Error()})
+		}
+	}
+	return len(emailFiles), invalid, nil
+}
+
+// AuditDirectory validates the email files GetEmailFiles finds in dir with
+// the default checks of ValidateEmailFile, without logging or queuing, and
+// returns the number of valid and invalid files and the invalid file names
+func AuditDirectory(dir string) (valid int, invalid int, files []string, err error) {
+	total, failures, err := FindInvalidEmails(dir, RunOptions{Scan: DefaultScanOptions(), Validation: DefaultValidationOptions()})
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	files = make([]string, len(failures))
+	for i, failure := range failures {
+		files[i] = failure.Filename
+	}
+	return total - len(failures), len(failures), files, nil
+}
+
+// WriteDeadLetterFile writes the failed emails to path as a JSON array,
+// writing an empty array when nothing failed
+func WriteDeadLetterFile(path string, failures []FailedEmail) error {
+	if failures == nil {
+		failures = []FailedEmail{}
+	}
+	return writeJSONFile(path, failures, "dead-letter file")
+}
+
+// ReadDeadLetterFile reads the failed emails from a file written by
+// WriteDeadLetterFile
+func ReadDeadLetterFile(path string) ([]FailedEmail, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead-letter file: %v", err)
+	}
+
+	var failures []FailedEmail
+	if err := json.Unmarshal(data, &failures); err != nil {
+		return nil, fmt.Errorf("invalid dead-letter file %s: %v", path, err)
+	}
+	return failures, nil
+}
+
+// summaryFile is the JSON form of a Summary written by WriteSummaryFile
+type summaryFile struct {
+	TotalFiles       int               `json:"total_files"`
+	SuccessCount     int               `json:"success_count"`
+	ErrorCount       int               `json:"error_count"`
+	SuccessRate      float64           `json:"success_rate"`
+	FailedFiles      []string          `json:"failed_files"`
+	Failures         []FailedEmail     `json:"failures"`
+	ValidationErrors map[string]int    `json:"validation_errors"`
+	Duplicates       int               `json:"duplicates"`
+	AlreadySubmitted int               `json:"already_submitted"`
+	AlreadyCompleted int               `json:"already_completed"`
+	Recovered        int               `json:"recovered"`
+	LimitReached     bool              `json:"limit_reached"`
+	MalformedLines   int               `json:"malformed_lines"`
+	Stale            int               `json:"stale"`
+	Resumed          int               `json:"resumed"`
+	TaskIDs          map[string]string `json:"task_ids"`
+	BatchID          string            `json:"batch_id,omitempty"`
+	DurationSeconds  float64           `json:"duration_seconds"`
+	QueueDepth       int               `json:"queue_depth"`
+	DepthSamples     int               `json:"queue_depth_samples"`
+	DepthMin         int               `json:"queue_depth_min"`
+	DepthMax         int               `json:"queue_depth_max"`
+	DepthAvg         float64           `json:"queue_depth_avg"`
+	SizeCount        int               `json:"size_count"`
+	SizeTotal        int64             `json:"size_total_bytes"`
+	SizeMax          int64             `json:"size_max_bytes"`
+	SizeAvg          float64           `json:"size_avg_bytes"`
+}
+
+// WriteSummaryFile writes the summary to path as a JSON object, with the
+// success rate as a percentage and the duration in seconds
+func WriteSummaryFile(path string, summary Summary) error {
+	out := summaryFile{
+		TotalFiles:       summary.TotalFiles,
+		SuccessCount:     summary.SuccessCount,
+		ErrorCount:       summary.ErrorCount,
+		SuccessRate:      summary.SuccessRate(),
+		FailedFiles:      summary.FailedFiles,
+		Failures:         summary.Failures,
+		ValidationErrors: summary.ValidationErrors,
+		Duplicates:       summary.Duplicates,
+		AlreadySubmitted: summary.AlreadySubmitted,
+		AlreadyCompleted: summary.AlreadyCompleted,
+		Recovered:        summary.Recovered,
+		LimitReached:     summary.LimitReached,
+		MalformedLines:   summary.MalformedLines,
+		Stale:            summary.Stale,
+		Resumed:          summary.Resumed,
+		TaskIDs:          summary.TaskIDs,
+		BatchID:          summary.BatchID,
+		DurationSeconds:  summary.Duration.Seconds(),
+		QueueDepth:       summary.QueueDepth,
+		DepthSamples:     summary.DepthStats.Samples,
+		DepthMin:         summary.DepthStats.Min,
+		DepthMax:         summary.DepthStats.Max,
+		DepthAvg:         summary.DepthStats.Avg,
+		SizeCount:        summary.SizeStats.Count,
+		SizeTotal:        summary.SizeStats.Total,
+		SizeMax:          summary.SizeStats.Max,
+		SizeAvg:          summary.SizeStats.Avg,
+	}
+	if out.FailedFiles == nil {
+		out.FailedFiles = []string{}
+	}
+	if out.Failures == nil {
+		out.Failures = []FailedEmail{}
+	}
+	if out.ValidationErrors == nil {
+		out.ValidationErrors = map[string]int{}
+	}
+	if out.TaskIDs == nil {
+		out.TaskIDs = map[string]string{}
+	}
+	return writeJSONFile(path, out, "summary file")
+}
+
+// WriteTaskIDFile writes the filename to task ID mapping to path as a JSON object
+func WriteTaskIDFile(path string, taskIDs map[string]string) error {
+	if taskIDs == nil {
+		taskIDs = map[string]string{}
+	}
+	return writeJSONFile(path, taskIDs, "task ID file")
+}
+
+// WriteResultsFile writes the task results collected by DrainResults to path
+// as a JSON object keyed by the queued filename
+func WriteResultsFile(path string, results map[string]interface{}) error {
+	if results == nil {
+		results = map[string]interface{}{}
+	}
+	return writeJSONFile(path, results, "results file")
+}
+
+// writeJSONFile writes v to path as indented JSON; what names the file in errors
+func writeJSONFile(path string, v interface{}, what string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", what, err)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", what, err)
+	}
+	return nil
+}
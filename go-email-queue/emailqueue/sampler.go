@@ -0,0 +1,83 @@
+package emailqueue
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultDepthSampleInterval is the queue depth sampling interval suggested
+// by the --depth-sample-interval help
+const DefaultDepthSampleInterval = 5 * time.Second
+
+// DepthStats summarizes the queue depth samples taken during a run
+type DepthStats struct {
+	Samples int     // Number of successful samples; the other fields are zero without samples
+	Min     int     // Smallest queue depth sampled
+	Max     int     // Largest queue depth sampled
+	Avg     float64 // Mean of the sampled queue depths
+}
+
+// record adds one sample to the stats
+func (s *DepthStats) record(depth int) {
+	if s.Samples == 0 || depth < s.Min {
+		s.Min = depth
+	}
+	if s.Samples == 0 || depth > s.Max {
+		s.Max = depth
+	}
+	s.Avg = (s.Avg*float64(s.Samples) + float64(depth)) / float64(s.Samples+1)
+	s.Samples++
+}
+
+// depthSampler samples the queue depth in the background until stopped
+type depthSampler struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	stats  DepthStats // Owned by the sampling goroutine until done is closed
+}
+
+// startDepthSampler samples the queue depth of manager every interval until
+// ctx is cancelled or the sampler is stopped, exporting each sample as the
+// email_queue_depth gauge. It returns nil when interval is not positive or in
+// dry-run mode, where nothing reaches the queue.
+func startDepthSampler(ctx context.Context, manager *EmailQueueManager, interval time.Duration) *depthSampler {
+	if interval <= 0 || manager.config.DryRun {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sampler := &depthSampler{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(sampler.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			depth, err := manager.QueueDepth()
+			if err != nil {
+				logDebug("queue_depth_sample_failed", Fields{"error": err}, "⚠️  Failed to sample the queue depth: %v", err)
+				continue
+			}
+			queueDepthGauge.Set(float64(depth))
+			logDebug("queue_depth_sampled", Fields{"queue_depth": depth}, "📉 Queue depth: %d pending tasks", depth)
+			sampler.stats.record(depth)
+		}
+	}()
+	return sampler
+}
+
+// Stop stops sampling and returns the stats of the samples taken; a nil
+// sampler returns empty stats
+func (s *depthSampler) Stop() DepthStats {
+	if s == nil {
+		return DepthStats{}
+	}
+	s.cancel()
+	<-s.done
+	return s.stats
+}
@@ -0,0 +1,159 @@
+package emailqueue
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocelery/gocelery"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Serializer selects how task bodies are encoded, matching Celery's
+// task_serializer setting
+type Serializer string
+
+const (
+	// SerializerJSON encodes task bodies as JSON, Celery's default
+	SerializerJSON Serializer = "json"
+	// SerializerMsgpack encodes task bodies as MessagePack
+	SerializerMsgpack Serializer = "msgpack"
+)
+
+// contentType returns the message content type Celery expects for the serializer
+func (s Serializer) contentType() string {
+	if s == SerializerMsgpack {
+		return "application/x-msgpack"
+	}
+	return "application/json"
+}
+
+// acceptedBy reports whether a worker whose accept_content setting lists
+// accept can decode the serializer. Entries may be serializer names or
+// content types, as in Celery.
+func (s Serializer) acceptedBy(accept []string) bool {
+	for _, entry := range accept {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == string(s) || entry == s.contentType() {
+			return true
+		}
+	}
+	return false
+}
+
+// msgpackTask is gocelery.TaskMessage with expires as an ISO 8601 string, as
+// Celery sends it. Encoded as is, the time.Time would become a msgpack
+// timestamp extension, which Celery's msgpack decoder does not read.
+type msgpackTask struct {
+	ID      string                 `json:"id"`
+	Task    string                 `json:"task"`
+	Args    []interface{}          `json:"args"`
+	Kwargs  map[string]interface{} `json:"kwargs"`
+	Retries int                    `json:"retries"`
+	ETA     *string                `json:"eta"`
+	Expires *string                `json:"expires"`
+}
+
+// newMsgpackTask converts a task message for msgpack encoding
+func newMsgpackTask(task *gocelery.TaskMessage) *msgpackTask {
+	wire := &msgpackTask{
+		ID:      task.ID,
+		Task:    task.Task,
+		Args:    task.Args,
+		Kwargs:  task.Kwargs,
+		Retries: task.Retries,
+		ETA:     task.ETA,
+	}
+	if task.Expires != nil {
+		expires := task.Expires.UTC().Format(time.RFC3339Nano)
+		wire.Expires = &expires
+	}
+	return wire
+}
+
+// taskMessage converts a decoded msgpack task back to a task message
+func (wire *msgpackTask) taskMessage() (*gocelery.TaskMessage, error) {
+	task := &gocelery.TaskMessage{
+		ID:      wire.ID,
+		Task:    wire.Task,
+		Args:    wire.Args,
+		Kwargs:  wire.Kwargs,
+		Retries: wire.Retries,
+		ETA:     wire.ETA,
+	}
+	if wire.Expires != nil {
+		expires, err := time.Parse(time.RFC3339Nano, *wire.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires: %v", err)
+		}
+		task.Expires = &expires
+	}
+	return task, nil
+}
+
+// encodeTask encodes a task message as a base64 body in the serializer's format
+func encodeTask(task *gocelery.TaskMessage, serializer Serializer) (string, error) {
+	if serializer != SerializerMsgpack {
+		return task.Encode()
+	}
+	return encodeBody(newMsgpackTask(task), serializer)
+}
+
+// encodeBody encodes value as a base64 message body in the serializer's
+// format. Structs are encoded by their json tags either way.
+func encodeBody(value interface{}, serializer Serializer) (string, error) {
+	var data []byte
+	if serializer == SerializerMsgpack {
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		encoder.SetCustomStructTag("json")
+		if err := encoder.Encode(value); err != nil {
+			return "", err
+		}
+		data = buf.Bytes()
+	} else {
+		var err error
+		if data, err = json.Marshal(value); err != nil {
+			return "", err
+		}
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decodeTask decodes a base64 task body with the given content type
+func decodeTask(body, contentType string) (*gocelery.TaskMessage, error) {
+	if contentType == SerializerMsgpack.contentType() {
+		var wire msgpackTask
+		if err := decodeBody(body, contentType, &wire); err != nil {
+			return nil, err
+		}
+		return wire.taskMessage()
+	}
+
+	var task gocelery.TaskMessage
+	if err := decodeBody(body, contentType, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// decodeBody decodes a base64 message body with the given content type into v
+func decodeBody(body, contentType string, v interface{}) error {
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return err
+	}
+
+	switch contentType {
+	case SerializerMsgpack.contentType():
+		decoder := msgpack.NewDecoder(bytes.NewReader(data))
+		decoder.SetCustomStructTag("json")
+		return decoder.Decode(v)
+	case SerializerJSON.contentType():
+		return json.Unmarshal(data, v)
+	}
+	return fmt.Errorf("unsupported content type %q", contentType)
+}
@@ -0,0 +1,125 @@
+package emailqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// DefaultListenAddr is the address the serve mode listens on
+const DefaultListenAddr = ":8080"
+
+// maxEnqueueBodyBytes bounds an /enqueue request body; it leaves headroom
+// over DefaultMaxContentBytes for the other fields and JSON escaping
+const maxEnqueueBodyBytes = 16 * 1024 * 1024
+
+// shutdownTimeout is how long the server waits for in-flight requests on exit
+const shutdownTimeout = 10 * time.Second
+
+// enqueueHandler serves POST /enqueue, validating a JSON email body and
+// submitting it to the queue as an inline payload. Of the run options,
+// Validation, NormalizeSubject and NormalizeFrom apply.
+type enqueueHandler struct {
+	manager *EmailQueueManager
+	opts    RunOptions
+}
+
+// newServeMux returns the routes of the serve mode
+func newServeMux(manager *EmailQueueManager, opts RunOptions) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/enqueue", &enqueueHandler{manager: manager, opts: opts})
+	return mux
+}
+
+// ServeHTTP handles a single enqueue request
+func (h *enqueueHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed, use POST"))
+		return
+	}
+
+	var email map[string]interface{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEnqueueBodyBytes))
+	if err := decoder.Decode(&email); err != nil || email == nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", tooLarge.Limit))
+			return
+		}
+		if err == nil {
+			err = errors.New("body is not a JSON object")
+		}
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON: %v", err))
+		return
+	}
+
+	if err := validatePayload(email, h.opts); err != nil {
+		logError("validation_failed", Fields{"remote_addr": r.RemoteAddr, "error": err},
+			"❌ Validation failed for request from %s: %v", r.RemoteAddr, err)
+		emailsValidationFailedTotal.Inc()
+		writeJSONError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	submitStart := time.Now()
+	taskID, err := submitPayload(r.Context(), h.manager, payloadDescription(email), email)
+	submissionDurationSeconds.Observe(time.Since(submitStart).Seconds())
+	if err != nil {
+		logError("submit_failed", Fields{"remote_addr": r.RemoteAddr, "error": err},
+			"❌ Failed to queue request from %s: %v", r.RemoteAddr, err)
+		emailsSubmissionFailedTotal.Inc()
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	emailsQueuedTotal.Inc()
+	writeJSON(w, http.StatusAccepted, map[string]string{"task_id": taskID})
+}
+
+// writeJSON writes v as the JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes {"error": ...} with the given status
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Serve runs the enqueue HTTP server on addr until ctx is cancelled, then
+// waits up to shutdownTimeout for in-flight requests. Request bodies are
+// validated and normalized as with opts.SendPayload in a run: of the run
+// options, Validation, NormalizeSubject and NormalizeFrom apply.
+func Serve(ctx context.Context, manager *EmailQueueManager, addr string, opts RunOptions) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newServeMux(manager, opts),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+	logInfo("server_started", Fields{"addr": addr}, "🌐 Accepting emails at POST http://%s/enqueue", addr)
+
+	select {
+	case err := <-errChan:
+		return fmt.Errorf("server stopped: %v", err)
+	case <-ctx.Done():
+	}
+
+	logInfo("server_stopping", nil, "🛑 Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down server: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package emailqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// streamThresholdBytes is the file size above which validateJSONEmailFile
+// decodes only the fields it checks instead of the whole email
+const streamThresholdBytes = 1024 * 1024
+
+// maxSkipDepth bounds the nesting of a skipped value, as encoding/json does
+const maxSkipDepth = 10000
+
+// validateJSONEmailFile runs the built-in checks on a JSON email file. Files
+// up to streamThresholdBytes are loaded whole, as LoadEmailFile does; larger
+// ones are walked token by token with a json.Decoder that decodes only the
+// fields ValidateEmail looks at. Other fields, such as attachment data, are
+// skipped one token at a time, so no Go value is built for them and memory
+// stays bounded by the largest single token rather than the file. Either way
+// the same checks run on the same values. Files are always loaded whole when
+// opts.Validators is set, since those validators may read any field.
+func validateJSONEmailFile(filePath string, opts ValidationOptions) error {
+	var email map[string]interface{}
+	err := withReadTimeout(opts.ReadTimeout, func() error {
+		info, err := statEmailFile(filePath, opts.MaxFileBytes)
+		if err != nil {
+			return err
+		}
+		if info.Size() <= streamThresholdBytes || len(opts.Validators) > 0 {
+			email, err = LoadEmailFile(filePath)
+			return err
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to read file: %v", err)
+		}
+		defer file.Close()
+
+		email, err = decodeEmailFields(bufio.NewReader(file), validatedFields(opts))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return ValidateEmail(email, opts)
+}
+
+// validatedFields returns the top-level fields ValidateEmail reads without a schema
+func validatedFields(opts ValidationOptions) map[string]bool {
+	fields := map[string]bool{
+		"from":              true,
+		"subject":           true,
+		opts.contentField(): true,
+		"to":                true,
+		"date":              true,
+	}
+	if opts.Attachments {
+		fields["attachments"] = true
+	}
+	return fields
+}
+
+// decodeEmailFields decodes a JSON email object from r, keeping only the
+// top-level fields in keep. A null document decodes to a nil map, as with
+// json.Unmarshal.
+func decodeEmailFields(r io.Reader, keep map[string]bool) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(r)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if token == nil {
+		return nil, expectEOF(decoder)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("email file must be a JSON object, got %s", jsonTokenKind(token))
+	}
+
+	email := make(map[string]interface{})
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		key := token.(string)
+
+		if keep[key] {
+			var value interface{}
+			if err := decoder.Decode(&value); err != nil {
+				return nil, fmt.Errorf("invalid JSON: %v", err)
+			}
+			email[key] = value
+		} else if err := skipValue(decoder); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return email, expectEOF(decoder)
+}
+
+// skipValue reads the next value from decoder token by token and discards
+// it, descending at most maxSkipDepth levels
+func skipValue(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if delim, ok := token.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				if depth++; depth > maxSkipDepth {
+					return errors.New("exceeded max depth")
+				}
+			default:
+				depth--
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// expectEOF fails when anything but whitespace follows the top-level value
+func expectEOF(decoder *json.Decoder) error {
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("invalid JSON: invalid character after top-level value")
+	}
+	return nil
+}
+
+// jsonTokenKind names the JSON type of a top-level token for errors
+func jsonTokenKind(token json.Token) string {
+	switch token.(type) {
+	case json.Delim:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "value"
+	}
+}
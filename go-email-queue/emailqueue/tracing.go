@@ -0,0 +1,103 @@
+package emailqueue
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans created by this service
+const tracerName = "go-email-queue"
+
+// tracingShutdownTimeout bounds how long FlushTracing waits for the exporter
+const tracingShutdownTimeout = 5 * time.Second
+
+// tracerProvider is set by SetupTracing. While it is set, each submission gets
+// a span and carries the trace context in its message headers.
+var tracerProvider *sdktrace.TracerProvider
+
+// SetupTracing exports spans over OTLP/HTTP to endpoint, e.g.
+// http://localhost:4318. Without a path the standard /v1/traces is used.
+// Call FlushTracing before exiting so buffered spans are sent.
+func SetupTracing(ctx context.Context, endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid OTLP endpoint %q: expected http(s)://host:port", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracerName))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+// FlushTracing sends buffered spans and stops the exporter. It does nothing
+// when tracing is not set up.
+func FlushTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logWarn("tracing_flush_failed", Fields{"error": err}, "⚠️  Failed to flush traces: %v", err)
+	}
+}
+
+// submitTraced calls submit inside a span covering the submission of one
+// email, passing it the trace context headers to attach to the task message.
+// Without tracing submit is called directly with nil headers.
+func submitTraced(ctx context.Context, emailFile string, submit func(headers map[string]interface{}) (string, error)) (string, error) {
+	if tracerProvider == nil {
+		return submit(nil)
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "email.submit",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("email.filename", emailFile)))
+	defer span.End()
+
+	taskID, err := submit(traceHeaders(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if taskID != "" {
+		span.SetAttributes(attribute.String("celery.task_id", taskID))
+	}
+	return taskID, err
+}
+
+// traceHeaders returns the W3C trace context of ctx as Celery message
+// headers, so workers can continue the trace
+func traceHeaders(ctx context.Context) map[string]interface{} {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	headers := make(map[string]interface{}, len(carrier))
+	for key, value := range carrier {
+		headers[key] = value
+	}
+	return headers
+}
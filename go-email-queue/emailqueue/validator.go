@@ -0,0 +1,214 @@
+package emailqueue
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Validator checks one rule on a parsed email. ValidateEmail runs a sequence
+// of validators and fails with the first error, so each validator may assume
+// the ones before it passed.
+type Validator interface {
+	Validate(email map[string]interface{}) error
+}
+
+// ValidatorFunc adapts a function to the Validator interface
+type ValidatorFunc func(email map[string]interface{}) error
+
+// Validate calls f(email)
+func (f ValidatorFunc) Validate(email map[string]interface{}) error {
+	return f(email)
+}
+
+// RequiredFieldsValidator requires each of Fields to be present and a string
+type RequiredFieldsValidator struct {
+	Fields []string
+}
+
+// Validate reports the first missing field, then the first that is not a string
+func (v RequiredFieldsValidator) Validate(email map[string]interface{}) error {
+	for _, field := range v.Fields {
+		if _, exists := email[field]; !exists {
+			return fmt.Errorf("missing required field: %s", field)
+		}
+	}
+	for _, field := range v.Fields {
+		if _, ok := email[field].(string); !ok {
+			return fmt.Errorf("%s must be a string, got %s", field, jsonTypeName(email[field]))
+		}
+	}
+	return nil
+}
+
+// NonEmptyValidator rejects a string Field that is empty or only whitespace
+type NonEmptyValidator struct {
+	Field string
+}
+
+// Validate checks the field has content
+func (v NonEmptyValidator) Validate(email map[string]interface{}) error {
+	if value, ok := email[v.Field].(string); ok && strings.TrimSpace(value) == "" {
+		return fmt.Errorf("%s must not be empty", v.Field)
+	}
+	return nil
+}
+
+// AddressValidator requires a string Field to be an RFC 5322 address, with or
+// without a display name
+type AddressValidator struct {
+	Field string
+}
+
+// Validate parses the address
+func (v AddressValidator) Validate(email map[string]interface{}) error {
+	address, ok := email[v.Field].(string)
+	if !ok {
+		return nil
+	}
+	if _, err := mail.ParseAddress(address); err != nil {
+		return fmt.Errorf("invalid %s address %q: %v", v.Field, address, err)
+	}
+	return nil
+}
+
+// MaxSizeValidator limits a string Field to MaxBytes, so the worker can handle
+// it; a MaxBytes of 0 disables the check
+type MaxSizeValidator struct {
+	Field    string
+	MaxBytes int
+}
+
+// Validate checks the field size
+func (v MaxSizeValidator) Validate(email map[string]interface{}) error {
+	if value, ok := email[v.Field].(string); ok && v.MaxBytes > 0 && len(value) > v.MaxBytes {
+		return fmt.Errorf("%s is %d bytes, exceeds limit of %d bytes", v.Field, len(value), v.MaxBytes)
+	}
+	return nil
+}
+
+// MaxLengthValidator limits a string Field to MaxChars characters; a MaxChars
+// of 0 disables the check
+type MaxLengthValidator struct {
+	Field    string
+	MaxChars int
+}
+
+// Validate counts the characters of the field
+func (v MaxLengthValidator) Validate(email map[string]interface{}) error {
+	value, ok := email[v.Field].(string)
+	if !ok || v.MaxChars <= 0 {
+		return nil
+	}
+	if length := utf8.RuneCountInString(value); length > v.MaxChars {
+		return fmt.Errorf("%s is %d characters, exceeds limit of %d characters", v.Field, length, v.MaxChars)
+	}
+	return nil
+}
+
+// HTMLValidator requires a string Field to contain markup rather than plain
+// text the classifier mishandles
+type HTMLValidator struct {
+	Field string
+}
+
+// Validate looks for an HTML tag
+func (v HTMLValidator) Validate(email map[string]interface{}) error {
+	if value, ok := email[v.Field].(string); ok && !looksLikeHTML(value) {
+		return fmt.Errorf("%s does not look like HTML: no tags found", v.Field)
+	}
+	return nil
+}
+
+// SchemaValidator validates the email against a compiled JSON Schema
+type SchemaValidator struct {
+	Schema *jsonschema.Schema
+}
+
+// Validate reports the first schema rule the email breaks
+func (v SchemaValidator) Validate(email map[string]interface{}) error {
+	return validateSchema(email, v.Schema)
+}
+
+// DefaultValidators returns the validators ValidateEmail runs for opts,
+// before opts.Validators: a schema or the required field, sender address and
+// content checks, then the content size, subject length, HTML, attachment and
+// strict checks enabled in opts
+func DefaultValidators(opts ValidationOptions) []Validator {
+	contentField := opts.contentField()
+
+	var validators []Validator
+	if opts.Schema != nil {
+		validators = append(validators, SchemaValidator{Schema: opts.Schema})
+	} else {
+		validators = append(validators,
+			RequiredFieldsValidator{Fields: []string{"from", "subject", contentField}},
+			NonEmptyValidator{Field: contentField},
+			AddressValidator{Field: "from"},
+		)
+	}
+	if opts.MaxContentBytes > 0 {
+		validators = append(validators, MaxSizeValidator{Field: contentField, MaxBytes: opts.MaxContentBytes})
+	}
+	if opts.MaxSubjectLength > 0 {
+		validators = append(validators, MaxLengthValidator{Field: "subject", MaxChars: opts.MaxSubjectLength})
+	}
+	if opts.RequireHTML {
+		validators = append(validators, HTMLValidator{Field: contentField})
+	}
+	if opts.Attachments {
+		validators = append(validators, ValidatorFunc(validateAttachments))
+	}
+	if opts.Strict {
+		validators = append(validators, ValidatorFunc(validateOptionalFields))
+	}
+	return validators
+}
+
+// NormalizeSubject trims the subject of email and collapses each run of
+// whitespace in it, including line breaks and tabs, into a single space. A
+// missing or non-string subject is left alone.
+func NormalizeSubject(email map[string]interface{}) {
+	if subject, ok := email["subject"].(string); ok {
+		email["subject"] = strings.Join(strings.Fields(subject), " ")
+	}
+}
+
+// OriginalFromField is the field NormalizeFrom keeps the unmodified from
+// address in
+const OriginalFromField = "original_from"
+
+// NormalizeFrom trims the from address of email and lowercases its domain,
+// so "Alice <Alice@Example.COM> " becomes "Alice <Alice@example.com>". The
+// local part and display name keep their case. The original value is kept in
+// OriginalFromField. A missing or non-string from is left alone.
+func NormalizeFrom(email map[string]interface{}) {
+	from, ok := email["from"].(string)
+	if !ok {
+		return
+	}
+	email[OriginalFromField] = from
+
+	normalized := strings.TrimSpace(from)
+	if at := strings.LastIndex(normalized, "@"); at >= 0 {
+		end := len(normalized)
+		if bracket := strings.Index(normalized[at:], ">"); bracket >= 0 {
+			end = at + bracket
+		}
+		normalized = normalized[:at+1] + strings.ToLower(normalized[at+1:end]) + normalized[end:]
+	}
+	email["from"] = normalized
+}
+
+// RunValidators runs validators in order and returns the first error
+func RunValidators(email map[string]interface{}, validators ...Validator) error {
+	for _, validator := range validators {
+		if err := validator.Validate(email); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package emailqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultWatchDebounce is how long Watch waits after the last write to a new
+// file before queuing it, so files are not read while still being written
+const DefaultWatchDebounce = 500 * time.Millisecond
+
+// Watch queues email files as they are created under dir until ctx is
+// cancelled or MaxEmails emails were queued. Only files created while
+// watching are queued; each is validated and submitted once no write to it
+// happened for DefaultWatchDebounce. Subdirectories, including new ones, are
+// watched unless opts.Scan.NonRecursive is set. Of the run options, Scan,
+// Validation, Rate, Burst, Dedupe, Idempotent, MaxBacklog, MaxEmails and the
+// submission options apply. The summary of the emails seen is returned
+// together with ctx.Err().
+func Watch(ctx context.Context, manager *EmailQueueManager, dir string, opts RunOptions) (Summary, error) {
+	start := time.Now()
+	summary := Summary{TaskIDs: make(map[string]string), QueueDepth: -1, BatchID: manager.BatchID()}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return summary, fmt.Errorf("failed to start file watcher: %v", err)
+	}
+	defer watcher.Close()
+
+	if err := watchTree(watcher, dir, opts.Scan); err != nil {
+		return summary, err
+	}
+	logInfo("watch_started", Fields{"dir": dir}, "👀 Watching %s for new email files (Ctrl+C to stop)", dir)
+
+	if opts.Idempotent && opts.IdempotencyKey == "" {
+		opts.IdempotencyKey = DefaultIdempotencyKey
+	}
+	limiter := newRateLimiter(opts.Rate, opts.Burst)
+	opts.queueLimits = newQueueLimiters(opts.RatePerQueue, opts.Burst)
+	opts.quota = newEmailQuota(opts.MaxEmails)
+	var seen *contentSet
+	if opts.Dedupe {
+		seen = newContentSet()
+	}
+
+	// Created files wait in pending until their debounce timer fires, which
+	// moves them to due under mu. A fired timer is never reset, so writes
+	// racing with it cannot queue the same file twice.
+	var mu sync.Mutex
+	pending := make(map[string]*time.Timer)
+	var due []string
+	wake := make(chan struct{}, 1)
+	schedule := func(path string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if timer, ok := pending[path]; ok && timer.Stop() {
+			timer.Reset(DefaultWatchDebounce)
+			return
+		}
+		var timer *time.Timer
+		timer = time.AfterFunc(DefaultWatchDebounce, func() {
+			mu.Lock()
+			if pending[path] == timer {
+				delete(pending, path)
+				due = append(due, path)
+			}
+			mu.Unlock()
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		})
+		pending[path] = timer
+	}
+	isPending := func(path string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		_, ok := pending[path]
+		return ok
+	}
+	nextDue := func() (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(due) == 0 {
+			return "", false
+		}
+		path := due[0]
+		due = due[1:]
+		return path, true
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, timer := range pending {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			summary.Duration = time.Since(start)
+			return summary, ctx.Err()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return summary, errors.New("file watcher stopped")
+			}
+			logWarn("watch_error", Fields{"error": err}, "⚠️  File watcher error: %v", err)
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return summary, errors.New("file watcher stopped")
+			}
+			switch {
+			case event.Has(fsnotify.Create):
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if !opts.Scan.NonRecursive {
+						if err := watchTree(watcher, event.Name, opts.Scan); err != nil {
+							logWarn("watch_error", Fields{"error": err}, "⚠️  %v", err)
+						}
+					}
+					continue
+				}
+				name := filepath.Base(event.Name)
+				if isEmailFileExtension(name, opts.Scan) && strings.HasPrefix(name, opts.Scan.Prefix) {
+					schedule(event.Name)
+				}
+			case event.Has(fsnotify.Write):
+				// Rapid writes to a created file push its submission back
+				if isPending(event.Name) {
+					schedule(event.Name)
+				}
+			}
+
+		case <-wake:
+			for {
+				path, ok := nextDue()
+				if !ok || ctx.Err() != nil {
+					break
+				}
+				emailFile, err := filepath.Rel(dir, path)
+				if err != nil {
+					emailFile = path
+				}
+				if limiter != nil && limiter.Wait(ctx) != nil {
+					continue
+				}
+				if waitForBacklog(ctx, manager, opts) != nil {
+					continue
+				}
+
+				summary.TotalFiles++
+				logInfo("email_processing", Fields{"filename": emailFile}, "\n📧 Processing new email: %s", emailFile)
+				taskID, err := processEmail(ctx, manager, seen, dir, emailFile, nil, opts)
+				switch {
+				case errors.Is(err, errLimitReached), errors.Is(err, errInterrupted):
+					summary.TotalFiles--
+				case errors.Is(err, errDuplicate):
+					summary.Duplicates++
+				case errors.Is(err, errAlreadySubmitted):
+					summary.AlreadySubmitted++
+				case errors.Is(err, errAlreadyCompleted):
+					summary.AlreadyCompleted++
+				case err != nil:
+					summary.recordFailure(emailFile, err)
+				default:
+					summary.SuccessCount++
+					if taskID != "" {
+						summary.TaskIDs[emailFile] = taskID
+					}
+					pauseAfterSubmit(ctx, manager, opts)
+				}
+
+				if opts.quota.full() {
+					summary.LimitReached = true
+					summary.Duration = time.Since(start)
+					logInfo("max_emails_reached", Fields{"max_emails": opts.MaxEmails},
+						"🔢 Queued %d emails, the --max-emails limit; stopping the watch", opts.MaxEmails)
+					return summary, nil
+				}
+			}
+		}
+	}
+}
+
+// watchTree adds dir to the watcher, with its subdirectories unless the scan
+// is non-recursive
+func watchTree(watcher *fsnotify.Watcher, dir string, scan ScanOptions) error {
+	if scan.NonRecursive {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %v", dir, err)
+		}
+		return nil
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("failed to watch %s: %v", path, err)
+		}
+		return nil
+	})
+}
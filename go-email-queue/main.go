@@ -1,208 +1,818 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gocelery/gocelery"
-	"github.com/gomodule/redigo/redis"
+	uuid "github.com/satori/go.uuid"
+
+	"go-email-queue/emailqueue"
 )
 
-// EmailQueueManager handles email queue operations using gocelery
-type EmailQueueManager struct {
-	celeryClient *gocelery.CeleryClient
-	queueName    string
+// logInfo logs an informational event through the emailqueue logger
+func logInfo(event string, fields emailqueue.Fields, format string, args ...interface{}) {
+	emailqueue.Log(emailqueue.LevelInfo, event, fields, format, args...)
 }
 
-// NewEmailQueueManager creates a new email queue manager using gocelery
-func NewEmailQueueManager(redisURL, queueName string) *EmailQueueManager {
-	// Create Redis connection pool
-	redisPool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			return redis.DialURL(redisURL)
-		},
-	}
+// logWarn logs a recoverable problem
+func logWarn(event string, fields emailqueue.Fields, format string, args ...interface{}) {
+	emailqueue.Log(emailqueue.LevelWarn, event, fields, format, args...)
+}
+
+// logError logs a failure
+func logError(event string, fields emailqueue.Fields, format string, args ...interface{}) {
+	emailqueue.Log(emailqueue.LevelError, event, fields, format, args...)
+}
 
-	// Create Redis broker for gocelery
-	redisBroker := gocelery.NewRedisBroker(redisPool)
+// logFatal logs an error event, whatever the log level, and exits with status 1
+func logFatal(event string, fields emailqueue.Fields, format string, args ...interface{}) {
+	emailqueue.CurrentLogger().Log(emailqueue.LevelError, event, fields, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
 
-	// Create Redis backend for gocelery
-	redisBackend := gocelery.NewRedisCeleryBackend(redisURL)
+// DefaultConfirmThreshold is the number of emails above which an interactive
+// run asks for confirmation before queuing
+const DefaultConfirmThreshold = 1000
+
+// confirmPrompt writes prompt to out and reports whether the answer read from
+// in is y or yes, in any case. Anything else, including EOF, declines.
+func confirmPrompt(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprint(out, prompt)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
 
-	// Create Celery client
-	celeryClient, err := gocelery.NewCeleryClient(redisBroker, redisBackend, 1)
-	if err != nil {
-		log.Fatalf("Failed to create Celery client: %v", err)
+// configEnv lists the settings without a flag that a --config file can set,
+// by the name of their environment variable
+var configEnv = []string{
+	"CELERY_TASK_NAME", "REDIS_PASSWORD", "REDIS_USE_TLS", "EMAIL_GLOB", "EMAIL_FILE_PREFIX",
+	"INCLUDE_YAML", "INCLUDE_GZIP", "SCAN_RECURSIVE", "MAX_CONTENT_BYTES", "CELERY_ACCEPT_CONTENT",
+}
+
+// envOrDefault returns the value of the environment variable key, or
+// fallback when it is unset or empty
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
 	}
+	return fallback
+}
 
-	return &EmailQueueManager{
-		celeryClient: celeryClient,
-		queueName:    queueName,
+// splitList splits a comma-separated list, dropping blank entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
 
-// Close closes the Celery client
-func (eq *EmailQueueManager) Close() {
-	// gocelery client doesn't need explicit closing
-	log.Println("📋 Celery client closed")
+// envDuration parses the environment variable key as a duration, returning
+// fallback when it is unset or empty. It runs before the logger is set up, so
+// an invalid value is fatal through the standard logger.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("❌ Invalid %s %q: %v", key, value, err)
+	}
+	return d
 }
 
-// AddEmailToQueue adds an email filename to the Celery queue using gocelery
-func (eq *EmailQueueManager) AddEmailToQueue(emailFilename string) error {
-	// Create task arguments
-	args := []interface{}{emailFilename}
+// drainTaskResults waits for the results of the tasks in taskIDs, keyed by
+// filename, logs how many arrived and writes them to outputPath when set
+func drainTaskResults(manager *emailqueue.EmailQueueManager, taskIDs map[string]string, timeout time.Duration, outputPath string) {
+	ids := make([]string, 0, len(taskIDs))
+	filenames := make(map[string]string, len(taskIDs))
+	for filename, taskID := range taskIDs {
+		ids = append(ids, taskID)
+		filenames[taskID] = filename
+	}
 
-	// Submit task using gocelery client
-	asyncResult, err := eq.celeryClient.Delay("app.tasks.process_email_task", args...)
+	logInfo("draining_results", emailqueue.Fields{"count": len(ids), "timeout": timeout.String()},
+		"\n📬 Waiting up to %v for %d task results", timeout, len(ids))
+	results, err := manager.DrainResults(ids, timeout)
 	if err != nil {
-		return fmt.Errorf("failed to submit task: %v", err)
+		logWarn("drain_incomplete", emailqueue.Fields{"error": err}, "⚠️  %v", err)
 	}
 
-	log.Printf("✅ Added email '%s' to queue with task ID: %s", emailFilename, asyncResult.TaskID)
-	return nil
+	if outputPath == "" {
+		return
+	}
+	byFilename := make(map[string]interface{}, len(results))
+	for taskID, result := range results {
+		byFilename[filenames[taskID]] = result
+	}
+	if err := emailqueue.WriteResultsFile(outputPath, byFilename); err != nil {
+		logError("results_output_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+	} else {
+		logInfo("results_output_written", emailqueue.Fields{"path": outputPath, "count": len(byFilename)},
+			"📝 Wrote %d task results to %s", len(byFilename), outputPath)
+	}
 }
 
-// GetEmailFiles returns all JSON email files from the test_data directory
-func GetEmailFiles(testDataDir string) ([]string, error) {
-	var emailFiles []string
+func main() {
+	// Settings from .env fill in variables the environment does not set;
+	// flags default to the environment, so load it before defining them
+	if err := emailqueue.LoadEnvFile(emailqueue.DefaultEnvFile); err != nil {
+		logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ %v", err)
+	}
 
-	err := filepath.Walk(testDataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	redisURLFlag := flag.String("redis-url", envOrDefault("REDIS_URL", "redis://localhost:6379/0"), "Redis URL of the result backend and, without --broker-url, the broker (env REDIS_URL)")
+	brokerURL := flag.String("broker-url", os.Getenv("CELERY_BROKER_URL"), "Broker URL, amqp:// for RabbitMQ or redis:// (env CELERY_BROKER_URL, default --redis-url)")
+	exchange := flag.String("exchange", os.Getenv("CELERY_EXCHANGE"), "AMQP exchange tasks are published to with --routing-key, e.g. a topic exchange (env CELERY_EXCHANGE, default: publish to the queue)")
+	routingKey := flag.String("routing-key", os.Getenv("CELERY_ROUTING_KEY"), "Routing key of every task instead of the queue name; required with --exchange, and needs it on an AMQP broker (env CELERY_ROUTING_KEY)")
+	fallbackRedisURL := flag.String("fallback-redis-url", os.Getenv("FALLBACK_REDIS_URL"), "Secondary Redis broker tasks are pushed to when the primary broker is unreachable (env FALLBACK_REDIS_URL)")
+	backendURL := flag.String("backend-url", os.Getenv("CELERY_RESULT_BACKEND"), "Redis URL of the result backend (env CELERY_RESULT_BACKEND, default --redis-url)")
+	queuesFlag := flag.String("queues", os.Getenv("CELERY_QUEUES"), "Comma-separated queues to spread tasks across instead of --queue (env CELERY_QUEUES)")
+	batchID := flag.String("batch-id", "", "ID sent as the batch_id header of every task in the run so workers can group its results (default: a generated UUID)")
+	protocolFlag := flag.String("protocol", envOrDefault("CELERY_TASK_PROTOCOL", "1"), "Celery message protocol, 1 or 2, matching the workers' task_protocol (env CELERY_TASK_PROTOCOL)")
+	serializer := flag.String("serializer", envOrDefault("CELERY_TASK_SERIALIZER", string(emailqueue.SerializerJSON)), "Task body encoding: json or msgpack, matching the workers' task_serializer (env CELERY_TASK_SERIALIZER)")
+	routing := flag.String("routing", string(emailqueue.RouteRoundRobin), "How tasks are spread across --queues: round-robin or hash (sticky by filename)")
+	queueNameFlag := flag.String("queue", envOrDefault("CELERY_QUEUE_NAME", "celery"), "Celery queue to submit tasks to (env CELERY_QUEUE_NAME)")
+	testDataDirFlag := flag.String("dir", envOrDefault("TEST_DATA_DIR", "/app/test_data"), "Directory to scan for email files, or the http(s) URL of a JSON index of email URLs (env TEST_DATA_DIR)")
+	fetchTimeout := flag.Duration("fetch-timeout", emailqueue.DefaultFetchTimeout, "Timeout of each HTTP request when --dir is a URL")
+	validateConcurrency := flag.Int("validate-concurrency", 0, "Validate all email files with this many workers before submitting the valid ones (0 validates each email just before its submission)")
+	concurrencyFlag := flag.Int("concurrency", 0, "Number of emails validated and submitted in parallel (env CONCURRENCY, default 1)")
+	maxFileBytes := flag.Int64("max-file-bytes", emailqueue.DefaultMaxFileBytes, "Email files larger than this many bytes fail without being read (0 disables the check)")
+	readTimeout := flag.Duration("read-timeout", emailqueue.DefaultReadTimeout, "Time after which reading an email file fails, e.g. on a stalled NFS mount (0 disables the timeout)")
+	contentField := flag.String("content-field", emailqueue.DefaultContentField, "Required field holding the email's HTML body, e.g. body_html")
+	strict := flag.Bool("strict", false, "Also validate the optional to and date fields when they are present")
+	validateAttachments := flag.Bool("validate-attachments", false, "Check that each entry of an email's attachments array has a filename and content_type")
+	maxSubjectLen := flag.Int("max-subject-len", 0, "Reject emails whose subject is longer than this many characters (0 disables the check)")
+	normalizeFrom := flag.Bool("normalize-from", false, "Trim the from address and lowercase its domain before queuing, keeping the original in original_from; requires an inline payload (--send-payload, --ndjson or an index URL)")
+	normalizeSubject := flag.Bool("normalize-subject", false, "Trim the subject and collapse its whitespace before validating and queuing inline payloads")
+	requireHTML := flag.Bool("require-html", false, "Reject emails whose content field contains no HTML tags, such as plain text bodies")
+	schemaPath := flag.String("schema", "", "Path to a JSON Schema that email files must satisfy, replacing the built-in field checks")
+	otelEndpoint := flag.String("otel-endpoint", "", "OTLP/HTTP endpoint to export submission traces to, e.g. http://localhost:4318 (disabled when empty)")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. :9090 (disabled when empty)")
+	submitDelay := flag.Duration("delay", envDuration("SUBMIT_DELAY", emailqueue.DefaultSubmitDelay), "Pause after each submission, per worker, e.g. 50ms (0 disables; env SUBMIT_DELAY)")
+	rateLimit := flag.Float64("rate", 0, "Maximum emails queued per second (0 disables rate limiting)")
+	ratePerQueue := flag.Float64("rate-per-queue", 0, "Maximum emails queued per second to each of the --queues, with a token bucket per queue (0 disables per-queue limiting)")
+	burst := flag.Int("burst", 1, "Emails that may be queued in a burst above --rate")
+	dedupe := flag.Bool("dedupe", false, "Skip emails whose from, subject and content field match an email already queued in this run")
+	idempotent := flag.Bool("idempotent", false, "Skip emails already submitted by a previous run, tracked in a Redis set")
+	sortOrder := flag.String("sort", string(emailqueue.SortByName), "Order in which email files are queued: name or mtime (oldest first)")
+	since := flag.Duration("since", 0, "Only queue email files modified within this duration, e.g. 6h, for incremental runs (0 includes all)")
+	maxEmails := flag.Int("max-emails", 0, "Stop after this many emails were queued (0 means no limit)")
+	yes := flag.Bool("yes", false, "Queue without asking for confirmation, for automation")
+	confirmThreshold := flag.Int("confirm-threshold", DefaultConfirmThreshold, "Ask for confirmation on a terminal before queuing more than this many emails (0 never asks)")
+	reportSizes := flag.Bool("report-sizes", false, "Report the total, average and largest size of the queued emails in the summary")
+	depthSample := flag.Duration("depth-sample-interval", 0, fmt.Sprintf("Sample the queue depth at this interval during the run and report its min, max and average, e.g. %v (0 disables sampling)", emailqueue.DefaultDepthSampleInterval))
+	checkpointPath := flag.String("checkpoint", "", "Record in this file how many email files were handled, so an interrupted run can be resumed with --resume")
+	resume := flag.Bool("resume", false, fmt.Sprintf("Skip the email files handled according to the --checkpoint file (default %s) of an interrupted run", emailqueue.DefaultCheckpointFile))
+	chunkSize := flag.Int("chunk-size", 0, "Queue emails in chunks of this many, logging a summary after each chunk (0 queues all files as one chunk)")
+	skipCompleted := flag.Bool("skip-completed", false, "Submit emails under task IDs derived from their filename and skip those whose task already succeeded")
+	deterministicIDs := flag.Bool("deterministic-ids", false, "Submit emails under task IDs derived from their filename, so re-runs reuse the same IDs")
+	idempotencyKey := flag.String("idempotency-key", emailqueue.DefaultIdempotencyKey, "Redis set holding the filename hashes of submitted emails")
+	maxBacklog := flag.Int("max-backlog", 0, "Pause queuing while more than this many tasks are pending (0 disables backpressure)")
+	retryFailed := flag.Int("retry-failed", 0, "Rounds of re-submission for emails whose submission failed, after the first pass (0 disables retries)")
+	deadLetterFile := flag.String("dead-letter-file", "", "Write the emails that failed to queue, with their errors, to this path as JSON")
+	failOnAnyError := flag.Bool("fail-on-any-error", false, "Exit with code 2 when any email failed, even if others were queued")
+	summaryJSON := flag.String("summary-json", "", "Write the run summary to this path as JSON, for CI jobs")
+	drainResults := flag.Duration("drain-results", 0, "After queuing, wait up to this long for the result of each queued task, e.g. 5m (0 does not wait)")
+	resultsOutput := flag.String("results-output", "", "Write a JSON object mapping each queued filename to its task result to this path; requires --drain-results")
+	taskIDOutput := flag.String("task-id-output", "", "Write a JSON object mapping each queued filename to its task ID to this path")
+	ndjsonPath := flag.String("ndjson", "", "Queue the emails in this newline-delimited JSON file as inline payloads instead of scanning the data directory")
+	requeueFrom := flag.String("requeue-from", "", "Re-validate and queue the emails listed in a dead-letter file written by --dead-letter-file")
+	validateOnlyChanged := flag.Bool("validate-only-changed", false, "Only validate and queue the email files added or modified since --base-ref, as listed by git diff")
+	baseRef := flag.String("base-ref", emailqueue.DefaultBaseRef, "Git ref --validate-only-changed compares the current branch against")
+	onlyInvalid := flag.Bool("only-invalid", false, "Validate every email file, print only the invalid ones with their errors and exit without connecting to Redis")
+	watch := flag.Bool("watch", false, "Keep running and queue new email files as they are created in the data directory, until interrupted")
+	fromStdin := flag.Bool("from-stdin", false, "Read newline-separated email file paths from stdin instead of scanning the data directory")
+	breakerThreshold := flag.Int("breaker-threshold", 0, "Consecutive submission failures that open the circuit breaker (0 disables it)")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "How long an open circuit breaker fails fast before probing Redis again")
+	sendPayload := flag.Bool("send-payload", os.Getenv("SEND_PAYLOAD") == "true", "Submit each email's full content as the task argument instead of its filename (env SEND_PAYLOAD)")
+	stripGzSuffix := flag.Bool("strip-gz-suffix", false, "Queue .json.gz files under their name without .gz, for workers that read decompressed copies")
+	noProgress := flag.Bool("no-progress", false, "Log every email instead of showing a progress bar when stdout is a terminal")
+	listenAddr := flag.String("listen", envOrDefault("LISTEN_ADDR", emailqueue.DefaultListenAddr), "Address the serve mode listens on (env LISTEN_ADDR)")
+	check := flag.Bool("check", false, "Check Redis connectivity with a PING, report the latency and exit 0 if reachable or 1 if not")
+	list := flag.Bool("list", false, "Print the tasks pending in the queue and exit without queuing")
+	listLimit := flag.Int("list-limit", 20, "Maximum number of tasks --list prints (0 prints all)")
+	purge := flag.Bool("purge", false, "Delete all pending tasks in the queue and exit without queuing")
+	dryRun := flag.Bool("dry-run", os.Getenv("DRY_RUN") == "true", "Validate email files and log what would be queued without submitting to Redis (env DRY_RUN)")
+	logLevel := flag.String("log-level", envOrDefault("LOG_LEVEL", "info"), "Least severe log output shown: debug, info, warn or error; the summary always prints (env LOG_LEVEL)")
+	logFormat := flag.String("log-format", os.Getenv("LOG_FORMAT"), "Log output format: text or json (default text)")
+	configPath := flag.String("config", "", "YAML or JSON file of settings keyed by flag name; flags given on the command line override it")
+	flag.Parse()
+
+	if *configPath != "" {
+		if err := emailqueue.LoadConfigFile(flag.CommandLine, *configPath, configEnv); err != nil {
+			log.Fatalf("❌ %v", err)
 		}
+	}
 
-		if !info.IsDir() && strings.HasSuffix(strings.ToLower(info.Name()), ".json") {
-			// Only include email files (not summary files)
-			if strings.HasPrefix(info.Name(), "email_") {
-				emailFiles = append(emailFiles, info.Name())
-			}
-		}
+	logger, err := emailqueue.NewLogger(*logFormat)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	emailqueue.SetLogger(logger)
+	level, err := emailqueue.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	emailqueue.SetLogLevel(level)
 
-		return nil
-	})
+	logInfo("startup", nil, "🚀 Starting Go Email Queue Manager")
+	logInfo("", nil, "=%s", strings.Repeat("=", 40))
 
+	// Configuration: flags take precedence, with env vars as their defaults
+	redisURL := *redisURLFlag
+	queueName, err := emailqueue.ExpandQueueName(*queueNameFlag)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read test_data directory: %v", err)
+		logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ Invalid --queue: %v", err)
+	}
+	queues := splitList(*queuesFlag)
+	for i := range queues {
+		if queues[i], err = emailqueue.ExpandQueueName(queues[i]); err != nil {
+			logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ Invalid --queues: %v", err)
+		}
 	}
+	testDataDir := *testDataDirFlag
 
-	return emailFiles, nil
-}
+	taskName := os.Getenv("CELERY_TASK_NAME")
+	if taskName == "" {
+		taskName = emailqueue.DefaultTaskName
+	}
 
-// ValidateEmailFile validates that an email file has the required structure
-func ValidateEmailFile(filePath string) error {
-	data, err := ioutil.ReadFile(filePath)
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	redisUseTLS := os.Getenv("REDIS_USE_TLS") == "true"
+
+	emailGlob := os.Getenv("EMAIL_GLOB")
+
+	scanOptions := emailqueue.DefaultScanOptions()
+	if prefix, ok := os.LookupEnv("EMAIL_FILE_PREFIX"); ok {
+		scanOptions.Prefix = prefix
+	}
+	scanOptions.IncludeYAML = os.Getenv("INCLUDE_YAML") == "true"
+	scanOptions.IncludeGzip = os.Getenv("INCLUDE_GZIP") == "true"
+	scanOptions.NonRecursive = os.Getenv("SCAN_RECURSIVE") == "false"
+	if scanOptions.Sort, err = emailqueue.ParseSortOrder(*sortOrder); err != nil {
+		logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ %v", err)
+	}
+	protocol, err := emailqueue.ParseProtocol(*protocolFlag)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %v", err)
+		logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ %v", err)
+	}
+	if *batchID == "" {
+		*batchID = uuid.Must(uuid.NewV4()).String()
+	}
+	if *since < 0 {
+		logFatal("config_invalid", nil, "❌ Invalid --since: must not be negative")
+	}
+	if *since > 0 {
+		scanOptions.Since = time.Now().Add(-*since)
 	}
 
-	var email map[string]interface{}
-	if err := json.Unmarshal(data, &email); err != nil {
-		return fmt.Errorf("invalid JSON: %v", err)
+	validationOptions := emailqueue.DefaultValidationOptions()
+	if maxContentBytes := os.Getenv("MAX_CONTENT_BYTES"); maxContentBytes != "" {
+		n, err := strconv.Atoi(maxContentBytes)
+		if err != nil {
+			logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ Invalid MAX_CONTENT_BYTES %q: %v", maxContentBytes, err)
+		}
+		validationOptions.MaxContentBytes = n
 	}
 
-	// Check required fields
-	requiredFields := []string{"from", "subject", "html_content"}
-	for _, field := range requiredFields {
-		if _, exists := email[field]; !exists {
-			return fmt.Errorf("missing required field: %s", field)
+	concurrency := 1
+	if *concurrencyFlag != 0 {
+		if *concurrencyFlag < 0 {
+			logFatal("config_invalid", nil, "❌ Invalid --concurrency %d: must be a positive integer", *concurrencyFlag)
+		}
+		concurrency = *concurrencyFlag
+	} else if value := os.Getenv("CONCURRENCY"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ Invalid CONCURRENCY %q: must be a positive integer", value)
 		}
+		concurrency = n
 	}
 
-	return nil
-}
+	if *requeueFrom != "" && (*fromStdin || *ndjsonPath != "") {
+		logFatal("config_invalid", nil, "❌ --requeue-from cannot be combined with --from-stdin or --ndjson")
+	}
+	if *onlyInvalid && (*fromStdin || *ndjsonPath != "" || *requeueFrom != "" || *watch || emailqueue.IsRemoteURL(testDataDir)) {
+		logFatal("config_invalid", nil, "❌ --only-invalid checks a local data directory and cannot be combined with --from-stdin, --ndjson, --requeue-from or --watch")
+	}
+	if *chunkSize < 0 {
+		logFatal("config_invalid", nil, "❌ Invalid --chunk-size: must not be negative")
+	}
+	if *validateConcurrency < 0 {
+		logFatal("config_invalid", nil, "❌ Invalid --validate-concurrency %d: must not be negative", *validateConcurrency)
+	}
+	if *drainResults < 0 {
+		logFatal("config_invalid", nil, "❌ Invalid --drain-results: must not be negative")
+	}
+	if *resultsOutput != "" && *drainResults == 0 {
+		logFatal("config_invalid", nil, "❌ --results-output requires --drain-results")
+	}
+	if *depthSample < 0 {
+		logFatal("config_invalid", nil, "❌ Invalid --depth-sample-interval: must not be negative")
+	}
+	if *resume && *checkpointPath == "" {
+		*checkpointPath = emailqueue.DefaultCheckpointFile
+	}
+	if *normalizeFrom && !*sendPayload && *ndjsonPath == "" && !emailqueue.IsRemoteURL(testDataDir) {
+		logFatal("config_invalid", nil, "❌ --normalize-from rewrites the submitted email and requires --send-payload, --ndjson or an index URL")
+	}
+	if *checkpointPath != "" && (*ndjsonPath != "" || *watch || emailqueue.IsRemoteURL(testDataDir)) {
+		logFatal("config_invalid", nil, "❌ --checkpoint and --resume need email files and cannot be combined with --ndjson, --watch or a remote index")
+	}
+	if *validateOnlyChanged && (*fromStdin || *ndjsonPath != "" || *requeueFrom != "" || *watch || emailqueue.IsRemoteURL(testDataDir)) {
+		logFatal("config_invalid", nil, "❌ --validate-only-changed lists files in a local git checkout and cannot be combined with --from-stdin, --ndjson, --requeue-from or --watch")
+	}
+	if *watch && (*fromStdin || *ndjsonPath != "" || *requeueFrom != "" || emailqueue.IsRemoteURL(testDataDir)) {
+		logFatal("config_invalid", nil, "❌ --watch needs a local data directory and cannot be combined with --from-stdin, --ndjson or --requeue-from")
+	}
 
-func main() {
-	log.Println("🚀 Starting Go Email Queue Manager")
-	log.Println("=" + strings.Repeat("=", 40))
+	validationOptions.Strict = *strict
+	validationOptions.RequireHTML = *requireHTML
+	if *maxSubjectLen < 0 {
+		logFatal("config_invalid", nil, "❌ Invalid --max-subject-len: must not be negative")
+	}
+	validationOptions.MaxSubjectLength = *maxSubjectLen
+	validationOptions.Attachments = *validateAttachments
+	if strings.TrimSpace(*contentField) == "" {
+		logFatal("config_invalid", nil, "❌ Invalid --content-field: must not be empty")
+	}
+	validationOptions.ContentField = *contentField
+	validationOptions.MaxFileBytes = *maxFileBytes
+	validationOptions.ReadTimeout = *readTimeout
+	if *schemaPath != "" {
+		schema, err := emailqueue.LoadSchema(*schemaPath)
+		if err != nil {
+			logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ %v", err)
+		}
+		validationOptions.Schema = schema
+	}
 
-	// Configuration
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379/0"
+	logInfo("", nil, "📋 Configuration:")
+	logInfo("config", emailqueue.Fields{"redis_url": emailqueue.RedactURL(redisURL)}, "  Redis URL: %s", emailqueue.RedactURL(redisURL))
+	logInfo("config", emailqueue.Fields{"redis_tls": redisUseTLS || strings.HasPrefix(redisURL, "rediss://")},
+		"  Redis TLS: %t", redisUseTLS || strings.HasPrefix(redisURL, "rediss://"))
+	if *brokerURL != "" {
+		logInfo("config", emailqueue.Fields{"broker_url": emailqueue.RedactURL(*brokerURL)}, "  Broker URL: %s", emailqueue.RedactURL(*brokerURL))
+	}
+	if *exchange != "" {
+		logInfo("config", emailqueue.Fields{"exchange": *exchange}, "  Exchange: %s", *exchange)
+	}
+	if *routingKey != "" {
+		logInfo("config", emailqueue.Fields{"routing_key": *routingKey}, "  Routing key: %s", *routingKey)
+	}
+	if *fallbackRedisURL != "" {
+		logInfo("config", emailqueue.Fields{"fallback_redis_url": emailqueue.RedactURL(*fallbackRedisURL)}, "  Fallback Redis URL: %s", emailqueue.RedactURL(*fallbackRedisURL))
+	}
+	if *backendURL != "" {
+		logInfo("config", emailqueue.Fields{"backend_url": emailqueue.RedactURL(*backendURL)}, "  Backend URL: %s", emailqueue.RedactURL(*backendURL))
+	}
+	if len(queues) > 0 {
+		logInfo("config", emailqueue.Fields{"queues": queues, "routing": *routing}, "  Queues: %s (%s)", strings.Join(queues, ", "), *routing)
+	} else {
+		logInfo("config", emailqueue.Fields{"queue_name": queueName}, "  Queue Name: %s", queueName)
+	}
+	logInfo("config", emailqueue.Fields{"task_name": taskName}, "  Task Name: %s", taskName)
+	logInfo("config", emailqueue.Fields{"batch_id": *batchID}, "  Batch ID: %s", *batchID)
+	logInfo("config", emailqueue.Fields{"test_data_dir": testDataDir}, "  Test Data Dir: %s", testDataDir)
+	if *ndjsonPath != "" {
+		logInfo("config", emailqueue.Fields{"ndjson": *ndjsonPath}, "  NDJSON File: %s", *ndjsonPath)
+	} else if *requeueFrom != "" {
+		logInfo("config", emailqueue.Fields{"requeue_from": *requeueFrom}, "  Requeue From: %s", *requeueFrom)
+	} else if *fromStdin {
+		logInfo("config", emailqueue.Fields{"file_source": "stdin"}, "  File Source: stdin")
+	} else if emailGlob != "" {
+		logInfo("config", emailqueue.Fields{"email_glob": emailGlob}, "  Email Glob: %s", emailGlob)
+	}
+	logInfo("config", emailqueue.Fields{"file_prefix": scanOptions.Prefix}, "  File Prefix: %q", scanOptions.Prefix)
+	logInfo("config", emailqueue.Fields{"include_yaml": scanOptions.IncludeYAML}, "  Include YAML: %t", scanOptions.IncludeYAML)
+	logInfo("config", emailqueue.Fields{"include_gzip": scanOptions.IncludeGzip}, "  Include Gzip: %t", scanOptions.IncludeGzip)
+	logInfo("config", emailqueue.Fields{"recursive_scan": !scanOptions.NonRecursive}, "  Recursive Scan: %t", !scanOptions.NonRecursive)
+	logInfo("config", emailqueue.Fields{"max_content_bytes": validationOptions.MaxContentBytes},
+		"  Max Content Bytes: %d", validationOptions.MaxContentBytes)
+	if validationOptions.ContentField != emailqueue.DefaultContentField {
+		logInfo("config", emailqueue.Fields{"content_field": validationOptions.ContentField}, "  Content Field: %s", validationOptions.ContentField)
+	}
+	if *schemaPath != "" {
+		logInfo("config", emailqueue.Fields{"schema": *schemaPath}, "  Schema: %s", *schemaPath)
+	}
+	logInfo("config", emailqueue.Fields{"concurrency": concurrency}, "  Concurrency: %d", concurrency)
+	if *validateConcurrency > 0 {
+		logInfo("config", emailqueue.Fields{"validate_concurrency": *validateConcurrency}, "  Validation concurrency: %d", *validateConcurrency)
+	}
+	if *maxBacklog > 0 {
+		logInfo("config", emailqueue.Fields{"max_backlog": *maxBacklog}, "  Max Backlog: %d tasks", *maxBacklog)
+	}
+	if *rateLimit > 0 {
+		logInfo("config", emailqueue.Fields{"rate": *rateLimit, "burst": *burst}, "  Rate Limit: %.2f emails/s (burst %d)", *rateLimit, *burst)
+	}
+	if *ratePerQueue > 0 {
+		logInfo("config", emailqueue.Fields{"rate_per_queue": *ratePerQueue, "burst": *burst}, "  Rate Limit per Queue: %.2f emails/s (burst %d)", *ratePerQueue, *burst)
 	}
 
-	queueName := os.Getenv("CELERY_QUEUE_NAME")
-	if queueName == "" {
-		queueName = "celery"
+	if *metricsAddr != "" {
+		emailqueue.StartMetricsServer(*metricsAddr)
 	}
 
-	testDataDir := os.Getenv("TEST_DATA_DIR")
-	if testDataDir == "" {
-		testDataDir = "/app/test_data"
+	if *otelEndpoint != "" {
+		if err := emailqueue.SetupTracing(context.Background(), *otelEndpoint); err != nil {
+			logFatal("config_invalid", emailqueue.Fields{"error": err}, "❌ %v", err)
+		}
+		defer emailqueue.FlushTracing()
+		logInfo("config", emailqueue.Fields{"otel_endpoint": *otelEndpoint}, "  Tracing: exporting spans to %s", *otelEndpoint)
 	}
 
-	log.Printf("📋 Configuration:")
-	log.Printf("  Redis URL: %s", redisURL)
-	log.Printf("  Queue Name: %s", queueName)
-	log.Printf("  Test Data Dir: %s", testDataDir)
+	// The git diff names files relative to the data directory
+	var changedFiles []string
+	if *validateOnlyChanged {
+		changed, err := emailqueue.ChangedEmailFiles(testDataDir, *baseRef, scanOptions)
+		if err != nil {
+			logFatal("changed_files_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+		}
+		if len(changed) == 0 {
+			logInfo("no_changed_files", emailqueue.Fields{"base_ref": *baseRef}, "✅ No email files changed since %s, nothing to do", *baseRef)
+			return
+		}
+		logInfo("changed_files", emailqueue.Fields{"base_ref": *baseRef, "count": len(changed)},
+			"🔀 %d email files changed since %s", len(changed), *baseRef)
+		changedFiles = make([]string, len(changed))
+		for i, file := range changed {
+			changedFiles[i] = filepath.Join(testDataDir, file)
+		}
+	}
+
+	// --only-invalid lints the data directory without a Redis connection
+	if *onlyInvalid {
+		total, invalid, err := emailqueue.FindInvalidEmails(testDataDir, emailqueue.RunOptions{Scan: scanOptions, Validation: validationOptions, Glob: emailGlob, Files: changedFiles})
+		if err != nil {
+			logFatal("scan_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+		}
+		for _, failure := range invalid {
+			logError("validation_failed", emailqueue.Fields{"filename": failure.Filename, "error": failure.Error},
+				"❌ %s: %s", failure.Filename, failure.Error)
+		}
+		logInfo("lint_completed", emailqueue.Fields{"total_files": total, "invalid_count": len(invalid)},
+			"🔎 %d of %d email files are invalid", len(invalid), total)
+		if len(invalid) > 0 {
+			emailqueue.FlushTracing()
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Initialize queue manager
-	queueManager := NewEmailQueueManager(redisURL, queueName)
+	queueManager, err := emailqueue.NewEmailQueueManager(emailqueue.Config{
+		RedisURL:         redisURL,
+		BrokerURL:        *brokerURL,
+		BackendURL:       *backendURL,
+		QueueName:        queueName,
+		TaskName:         taskName,
+		Password:         redisPassword,
+		UseTLS:           redisUseTLS,
+		DryRun:           *dryRun,
+		Queues:           queues,
+		Routing:          emailqueue.RoutingStrategy(*routing),
+		BreakerThreshold: *breakerThreshold,
+		BreakerCooldown:  *breakerCooldown,
+		Serializer:       emailqueue.Serializer(*serializer),
+		AcceptContent:    splitList(os.Getenv("CELERY_ACCEPT_CONTENT")),
+		Protocol:         protocol,
+		BatchID:          *batchID,
+		Exchange:         *exchange,
+		RoutingKey:       *routingKey,
+		FallbackRedisURL: *fallbackRedisURL,
+	})
+	if err != nil {
+		logFatal("init_failed", emailqueue.Fields{"error": err}, "❌ Failed to initialize queue manager: %v", err)
+	}
 	defer queueManager.Close()
 
-	log.Println("✅ Celery client initialized successfully")
+	logInfo("client_initialized", nil, "✅ Celery client initialized successfully")
 
-	// Get email files
-	emailFiles, err := GetEmailFiles(testDataDir)
-	if err != nil {
-		log.Fatalf("❌ Failed to get email files: %v", err)
+	if *check {
+		target, probe := "Redis", "PING"
+		if emailqueue.IsAMQPURL(*brokerURL) {
+			target, probe = "RabbitMQ", "connect"
+		}
+		latency, err := queueManager.HealthCheck()
+		if err != nil {
+			logError("health_check_failed", emailqueue.Fields{"error": err}, "❌ %s health check failed: %v", target, err)
+			queueManager.Close()
+			emailqueue.FlushTracing()
+			os.Exit(1)
+		}
+		logInfo("health_check_passed", emailqueue.Fields{"latency": latency.String()},
+			"💚 %s is reachable (%s latency %v)", target, probe, latency.Round(time.Microsecond))
+		return
 	}
 
-	if len(emailFiles) == 0 {
-		log.Fatalf("❌ No email files found in %s", testDataDir)
+	if *list {
+		tasks, err := queueManager.ListPendingTasks(*listLimit)
+		if err != nil {
+			logError("list_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+			queueManager.Close()
+			emailqueue.FlushTracing()
+			os.Exit(1)
+		}
+		for _, task := range tasks {
+			args, _ := json.Marshal(task.Args)
+			logInfo("pending_task", emailqueue.Fields{"queue_name": task.Queue, "task_id": task.ID, "task": task.Task, "args": task.Args},
+				"📋 [%s] %s %s %s", task.Queue, task.ID, task.Task, args)
+		}
+		logInfo("tasks_listed", emailqueue.Fields{"count": len(tasks)}, "📥 Listed %d pending tasks", len(tasks))
+		return
 	}
 
-	log.Printf("📧 Found %d email files", len(emailFiles))
-
-	// Validate and queue emails
-	successCount := 0
-	errorCount := 0
+	if *purge {
+		removed, err := queueManager.PurgeQueue()
+		if err != nil {
+			logError("purge_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+			queueManager.Close()
+			emailqueue.FlushTracing()
+			os.Exit(1)
+		}
+		purgedQueues := strings.Join(queueManager.QueueNames(), ", ")
+		logInfo("queue_purged", emailqueue.Fields{"queue_name": purgedQueues, "removed": removed},
+			"🧹 Purged %d pending tasks from queue '%s'", removed, purgedQueues)
+		return
+	}
 
-	for i, emailFile := range emailFiles {
-		log.Printf("\n📧 Processing email %d/%d: %s", i+1, len(emailFiles), emailFile)
+	// Stop after the current email on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// "serve" runs the enqueue HTTP endpoint instead of a batch
+	if flag.Arg(0) == "serve" {
+		if err := emailqueue.Serve(ctx, queueManager, *listenAddr, emailqueue.RunOptions{
+			Validation:       validationOptions,
+			NormalizeSubject: *normalizeSubject,
+			NormalizeFrom:    *normalizeFrom,
+		}); err != nil {
+			logError("server_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+			queueManager.Close()
+			emailqueue.FlushTracing()
+			os.Exit(1)
+		}
+		return
+	}
 
-		// Validate email file
-		filePath := filepath.Join(testDataDir, emailFile)
-		if err := ValidateEmailFile(filePath); err != nil {
-			log.Printf("❌ Validation failed for %s: %v", emailFile, err)
-			errorCount++
-			continue
+	listedFiles := changedFiles
+	if *fromStdin {
+		listedFiles, err = emailqueue.ReadFileList(os.Stdin)
+		if err != nil {
+			queueManager.Close()
+			logFatal("file_list_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
 		}
+	}
 
-		// Add to queue
-		if err := queueManager.AddEmailToQueue(emailFile); err != nil {
-			log.Printf("❌ Failed to queue %s: %v", emailFile, err)
-			errorCount++
-			continue
+	// The dead-letter file names emails relative to the data directory
+	if *requeueFrom != "" {
+		failures, err := emailqueue.ReadDeadLetterFile(*requeueFrom)
+		if err != nil {
+			queueManager.Close()
+			logFatal("file_list_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+		}
+		if len(failures) == 0 {
+			logInfo("requeue_empty", emailqueue.Fields{"path": *requeueFrom}, "✅ No failed emails in %s, nothing to requeue", *requeueFrom)
+			return
 		}
+		listedFiles = make([]string, 0, len(failures))
+		for _, failure := range failures {
+			listedFiles = append(listedFiles, filepath.Join(testDataDir, failure.Filename))
+		}
+	}
 
-		successCount++
+	// Replace the per-email lines with a progress bar on interactive runs
+	var progress func(processed, total int, result error)
+	var bar *progressBar
+	if !*noProgress && !*watch && *logFormat != "json" && isTerminal(os.Stdout) {
+		bar = newProgressBar(os.Stdout)
+		progress = bar.Update
+		emailqueue.SetLogger(progressLogger{next: logger, bar: bar})
+	}
 
-		// Small delay to avoid overwhelming the queue
-		time.Sleep(100 * time.Millisecond)
+	runOptions := emailqueue.RunOptions{
+		Files:               listedFiles,
+		Scan:                scanOptions,
+		Validation:          validationOptions,
+		Glob:                emailGlob,
+		Concurrency:         concurrency,
+		ValidateConcurrency: *validateConcurrency,
+		Rate:                *rateLimit,
+		RatePerQueue:        *ratePerQueue,
+		Burst:               *burst,
+		Dedupe:              *dedupe,
+		Idempotent:          *idempotent,
+		IdempotencyKey:      *idempotencyKey,
+		MaxBacklog:          *maxBacklog,
+		RetryFailed:         *retryFailed,
+		Progress:            progress,
+		StripGzSuffix:       *stripGzSuffix,
+		SendPayload:         *sendPayload,
+		NormalizeSubject:    *normalizeSubject,
+		NormalizeFrom:       *normalizeFrom,
+		Delay:               *submitDelay,
+		SkipCompleted:       *skipCompleted,
+		DeterministicIDs:    *deterministicIDs,
+		MaxEmails:           *maxEmails,
+		FetchTimeout:        *fetchTimeout,
+		ChunkSize:           *chunkSize,
+		DepthSample:         *depthSample,
+		ReportSizes:         *reportSizes,
+		Checkpoint:          *checkpointPath,
+		Resume:              *resume,
+	}
+	// Ask before flooding the queue; only a person at a terminal can answer
+	if !*yes && !*dryRun && *confirmThreshold > 0 && isTerminal(os.Stdin) {
+		runOptions.Confirm = func(count int) bool {
+			if count <= *confirmThreshold {
+				return true
+			}
+			return confirmPrompt(os.Stdin, os.Stdout, fmt.Sprintf("About to queue %d emails. Continue? [y/N] ", count))
+		}
+	}
+
+	var summary emailqueue.Summary
+	if *ndjsonPath != "" {
+		summary, err = emailqueue.RunNDJSON(ctx, queueManager, *ndjsonPath, runOptions)
+	} else if *watch {
+		summary, err = emailqueue.Watch(ctx, queueManager, testDataDir, runOptions)
+	} else if emailqueue.IsRemoteURL(testDataDir) {
+		summary, err = emailqueue.RunRemoteIndex(ctx, queueManager, testDataDir, runOptions)
+	} else {
+		summary, err = emailqueue.RunQueueWithOptions(ctx, queueManager, testDataDir, runOptions)
+	}
+	if bar != nil {
+		bar.Finish()
+		emailqueue.SetLogger(logger)
+	}
+	if errors.Is(err, emailqueue.ErrNotConfirmed) {
+		logInfo("run_aborted", nil, "🛑 Aborted, nothing was queued")
+		queueManager.Close()
+		emailqueue.FlushTracing()
+		os.Exit(1)
+	}
+	interrupted := errors.Is(err, context.Canceled)
+	if err != nil && !interrupted {
+		logError("run_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+		queueManager.Close()
+		emailqueue.FlushTracing()
+		os.Exit(1)
 	}
 
 	// Summary
-	log.Println("\n📊 Processing Summary")
-	log.Println("=" + strings.Repeat("=", 30))
-	log.Printf("✅ Successfully queued: %d emails", successCount)
-	log.Printf("❌ Failed: %d emails", errorCount)
-	log.Printf("📈 Success rate: %.1f%%", float64(successCount)/float64(len(emailFiles))*100)
-
-	if successCount > 0 {
-		log.Println("\n🎉 Email queue processing completed successfully!")
-		log.Printf("💡 Monitor queue status at: http://localhost:8081 (Redis Commander)")
-		log.Printf("🌸 Monitor Celery tasks at: http://localhost:5555 (Flower)")
+	// The summary prints even when --log-level hides informational events
+	if emailqueue.LogLevel() > emailqueue.LevelInfo {
+		emailqueue.SetLogLevel(emailqueue.LevelInfo)
+	}
+	logInfo("", nil, "\n📊 Processing Summary")
+	logInfo("", nil, "=%s", strings.Repeat("=", 30))
+	summaryFields := emailqueue.Fields{
+		"success_count":     summary.SuccessCount,
+		"error_count":       summary.ErrorCount,
+		"success_rate":      summary.SuccessRate(),
+		"failed_files":      summary.FailedFiles,
+		"duplicates":        summary.Duplicates,
+		"already_submitted": summary.AlreadySubmitted,
+		"already_completed": summary.AlreadyCompleted,
+		"recovered":         summary.Recovered,
+		"malformed_lines":   summary.MalformedLines,
+		"stale":             summary.Stale,
+		"resumed":           summary.Resumed,
+		"validation_errors": summary.ValidationErrors,
+		"duration":          summary.Duration.String(),
+		"batch_id":          summary.BatchID,
+	}
+	if *dryRun {
+		summaryFields["dry_run"] = true
+		logInfo("summary", summaryFields, "🧪 Would have queued: %d emails", summary.SuccessCount)
+	} else {
+		logInfo("summary", summaryFields, "✅ Successfully queued: %d emails", summary.SuccessCount)
+	}
+	logInfo("", nil, "❌ Failed: %d emails", summary.ErrorCount)
+	if summary.BatchID != "" {
+		logInfo("", nil, "🏷️  Batch ID: %s", summary.BatchID)
+	}
+	if len(summary.ValidationErrors) > 0 {
+		logInfo("", nil, "🧾 Validation errors by type:")
+		for _, message := range summary.SortedValidationErrors() {
+			logInfo("", nil, "   %s: %d", message, summary.ValidationErrors[message])
+		}
+	}
+	if *dedupe {
+		logInfo("", nil, "♻️  Duplicates skipped: %d emails", summary.Duplicates)
+	}
+	if *idempotent {
+		logInfo("", nil, "⏭️  Already submitted: %d emails", summary.AlreadySubmitted)
+	}
+	if *skipCompleted {
+		logInfo("", nil, "🏁 Already completed: %d emails", summary.AlreadyCompleted)
+	}
+	if *ndjsonPath != "" {
+		logInfo("", nil, "🧩 Malformed lines: %d", summary.MalformedLines)
+	}
+	if *resume {
+		logInfo("", nil, "⏩ Skipped by --resume: %d emails", summary.Resumed)
+	}
+	if *since > 0 {
+		logInfo("", nil, "🕰️  Stale files skipped: %d", summary.Stale)
+	}
+	if summary.Recovered > 0 {
+		logInfo("", nil, "🔁 Recovered by retries: %d emails", summary.Recovered)
+	}
+	if *requeueFrom != "" {
+		logInfo("requeued", emailqueue.Fields{"path": *requeueFrom, "requeued": summary.SuccessCount, "total": summary.TotalFiles},
+			"🔁 Requeued %d of %d emails from %s", summary.SuccessCount, summary.TotalFiles, *requeueFrom)
+	}
+	logInfo("", nil, "📈 Success rate: %.1f%%", summary.SuccessRate())
+	logInfo("", nil, "⏱️  Duration: %v", summary.Duration.Round(time.Millisecond))
+	if summary.QueueDepth >= 0 {
+		logInfo("", nil, "📥 Queue depth: %d pending tasks", summary.QueueDepth)
+	}
+	if summary.DepthStats.Samples > 0 {
+		depth := summary.DepthStats
+		logInfo("queue_depth_stats", emailqueue.Fields{"samples": depth.Samples, "min": depth.Min, "max": depth.Max, "avg": depth.Avg},
+			"📉 Queue depth during run: min %d, avg %.1f, max %d over %d samples", depth.Min, depth.Avg, depth.Max, depth.Samples)
+	}
+	if *reportSizes {
+		sizes := summary.SizeStats
+		logInfo("email_sizes", emailqueue.Fields{"count": sizes.Count, "total_bytes": sizes.Total, "max_bytes": sizes.Max, "avg_bytes": sizes.Avg},
+			"📦 Queued content: %d bytes total, avg %.0f bytes, max %d bytes", sizes.Total, sizes.Avg, sizes.Max)
+	}
+
+	if *summaryJSON != "" {
+		if err := emailqueue.WriteSummaryFile(*summaryJSON, summary); err != nil {
+			logError("summary_json_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+		} else {
+			logInfo("summary_json_written", emailqueue.Fields{"path": *summaryJSON}, "📝 Wrote the run summary to %s", *summaryJSON)
+		}
+	}
+
+	if *taskIDOutput != "" {
+		if err := emailqueue.WriteTaskIDFile(*taskIDOutput, summary.TaskIDs); err != nil {
+			logError("task_id_output_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+		} else {
+			logInfo("task_id_output_written", emailqueue.Fields{"path": *taskIDOutput, "count": len(summary.TaskIDs)},
+				"📝 Wrote %d task IDs to %s", len(summary.TaskIDs), *taskIDOutput)
+		}
+	}
+
+	if *drainResults > 0 && len(summary.TaskIDs) > 0 && !interrupted {
+		drainTaskResults(queueManager, summary.TaskIDs, *drainResults, *resultsOutput)
+	}
+
+	if *deadLetterFile != "" {
+		if err := emailqueue.WriteDeadLetterFile(*deadLetterFile, summary.Failures); err != nil {
+			logError("dead_letter_failed", emailqueue.Fields{"error": err}, "❌ %v", err)
+		} else {
+			logInfo("dead_letter_written", emailqueue.Fields{"path": *deadLetterFile, "count": len(summary.Failures)},
+				"📝 Wrote %d failed emails to %s", len(summary.Failures), *deadLetterFile)
+		}
+	}
+
+	if interrupted {
+		logWarn("interrupted", emailqueue.Fields{"processed": summary.SuccessCount + summary.ErrorCount, "total": summary.TotalFiles},
+			"\n🛑 Interrupted after %d of %d emails", summary.SuccessCount+summary.ErrorCount, summary.TotalFiles)
+		queueManager.Close()
+		emailqueue.FlushTracing()
+		os.Exit(130)
+	}
+
+	// Checked first so a run where every email failed exits 2 as well
+	if *failOnAnyError && summary.ErrorCount > 0 {
+		logError("partial_failure", emailqueue.Fields{"error_count": summary.ErrorCount},
+			"❌ %d emails failed and --fail-on-any-error is set", summary.ErrorCount)
+		queueManager.Close()
+		emailqueue.FlushTracing()
+		os.Exit(2)
+	}
+
+	if summary.SuccessCount > 0 {
+		logInfo("completed", nil, "\n🎉 Email queue processing completed successfully!")
+		logInfo("", nil, "💡 Monitor queue status at: http://localhost:8081 (Redis Commander)")
+		logInfo("", nil, "🌸 Monitor Celery tasks at: http://localhost:5555 (Flower)")
+	} else if summary.ErrorCount == 0 && summary.AlreadySubmitted+summary.AlreadyCompleted > 0 {
+		logInfo("completed", nil, "\n✅ Every email was already submitted by a previous run, nothing to queue")
 	} else {
-		log.Println("\n❌ No emails were successfully queued")
+		logError("nothing_queued", nil, "\n❌ No emails were successfully queued")
+		queueManager.Close()
+		emailqueue.FlushTracing()
 		os.Exit(1)
 	}
 }
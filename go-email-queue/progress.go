@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go-email-queue/emailqueue"
+)
+
+// progressBarWidth is the number of cells in the rendered bar
+const progressBarWidth = 30
+
+// perEmailEvents are the informational events logged once per email, which
+// the progress bar replaces
+var perEmailEvents = map[string]bool{
+	"email_processing":  true,
+	"email_queued":      true,
+	"dry_run":           true,
+	"duplicate_skipped": true,
+	"already_submitted": true,
+	"already_completed": true,
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBar renders a single self-overwriting status line with the number
+// of processed emails, success and failure counts and an ETA
+type progressBar struct {
+	mu        sync.Mutex
+	out       io.Writer
+	start     time.Time
+	total     int
+	processed int
+	succeeded int
+	skipped   int
+	failed    int
+}
+
+// newProgressBar returns a progress bar drawing to out
+func newProgressBar(out io.Writer) *progressBar {
+	return &progressBar{out: out, start: time.Now()}
+}
+
+// Update records the result of one email and redraws the bar. It matches
+// RunOptions.Progress.
+func (p *progressBar) Update(processed, total int, result error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.processed, p.total = processed, total
+	switch {
+	case result == nil:
+		p.succeeded++
+	case emailqueue.IsSkipped(result):
+		p.skipped++
+	default:
+		p.failed++
+	}
+	p.render()
+}
+
+// Finish ends the status line so later output starts on a fresh line
+func (p *progressBar) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.total > 0 {
+		fmt.Fprintln(p.out)
+	}
+}
+
+// render draws the bar; callers hold p.mu
+func (p *progressBar) render() {
+	if p.total == 0 {
+		return
+	}
+
+	filled := p.processed * progressBarWidth / p.total
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled)
+
+	eta := "--"
+	if p.processed > 0 && p.processed < p.total {
+		elapsed := time.Since(p.start)
+		remaining := elapsed / time.Duration(p.processed) * time.Duration(p.total-p.processed)
+		eta = remaining.Round(time.Second).String()
+	} else if p.processed == p.total {
+		eta = "done"
+	}
+
+	line := fmt.Sprintf("📧 %s %d/%d ✅ %d ❌ %d", bar, p.processed, p.total, p.succeeded, p.failed)
+	if p.skipped > 0 {
+		line += fmt.Sprintf(" ⏭️  %d", p.skipped)
+	}
+	fmt.Fprintf(p.out, "\r\033[K%s ETA %s", line, eta)
+}
+
+// clear erases the status line; callers hold p.mu
+func (p *progressBar) clear() {
+	if p.total > 0 {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+}
+
+// progressLogger drops per-email informational events while the progress bar
+// is shown and keeps the bar below any other log line
+type progressLogger struct {
+	next emailqueue.Logger
+	bar  *progressBar
+}
+
+// Log forwards the event unless the progress bar replaces it
+func (l progressLogger) Log(level emailqueue.Level, event string, fields emailqueue.Fields, message string) {
+	if level == emailqueue.LevelInfo && perEmailEvents[event] {
+		return
+	}
+
+	l.bar.mu.Lock()
+	defer l.bar.mu.Unlock()
+	l.bar.clear()
+	l.next.Log(level, event, fields, message)
+	l.bar.render()
+}